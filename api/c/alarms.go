@@ -0,0 +1,68 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/panjjo/gosip/db"
+	"github.com/panjjo/gosip/m"
+	sipapi "github.com/panjjo/gosip/sip"
+)
+
+type AlarmsListResponse struct {
+	Total int64
+	List  []sipapi.Alarms
+}
+
+// @Summary     报警列表接口
+// @Description 可以根据查询条件查询设备报警列表
+// @Tags        alarms
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       limit   query    integer false "条数(0-100) 默认20"
+// @Param       skip    query    integer false "间隔 默认0"
+// @Param       sort    query    string  false "排序,例:-key,根据key倒序,key,根据key正序"
+// @Param       filters query    string  false "查询条件,使用规则详情请看帮助"
+// @Success     0       {object} AlarmsListResponse
+// @Failure     1000    {object} string
+// @Failure     1001    {object} string
+// @Failure     1002    {object} string
+// @Failure     1003    {object} string
+// @Router      /alarms [get]
+func AlarmsList(c *gin.Context) {
+	limit := m.GetLimit(c)
+	skip := m.GetSkip(c)
+	sort := m.GetSort(c)
+	alarms := []sipapi.Alarms{}
+	total, err := db.FindWithJson(db.DBClient, new(sipapi.Alarms), &alarms, c.Query("filters"), sort, skip, limit, true)
+	if err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, AlarmsListResponse{
+		Total: total,
+		List:  alarms,
+	})
+}
+
+// @Summary     报警复位
+// @Description 向设备发送报警复位指令，并将对应报警标记为已复位
+// @Tags        alarms
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id        path     string true  "设备id"
+// @Param       channelid formData string false "报警通道或报警设备编号，默认设备id"
+// @Param       method    formData string false "报警方式，为空复位全部"
+// @Param       type      formData string false "报警类型，为空复位全部"
+// @Success     0         {object} string
+// @Failure     1000      {object} string
+// @Failure     1001      {object} string
+// @Failure     1002      {object} string
+// @Failure     1003      {object} string
+// @Router      /devices/{id}/alarms/reset [post]
+func AlarmReset(c *gin.Context) {
+	deviceid := c.Param("id")
+	if err := sipapi.SipAlarmReset(c.Request.Context(), deviceid, c.PostForm("channelid"), c.PostForm("method"), c.PostForm("type")); err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, err.Error())
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, "")
+}
@@ -83,6 +83,7 @@ func ChannelCreate(c *gin.Context) {
 // @Param       memo       formData string false "通道备注"
 // @Param       streamtype formData string false "播放类型，pull 媒体服务器拉流，push 摄像头推流,默认push"
 // @Param       url        formData string false "静态拉流地址，streamtype=pull 时生效。"
+// @Param       groupid    formData string false "所属分组编码，传-移出分组"
 // @Success     0          {object} sipapi.Channels
 // @Failure     1000       {object} string
 // @Failure     1001       {object} string
@@ -119,6 +120,19 @@ func ChannelsUpdate(c *gin.Context) {
 	if streamtype != "" && channel.StreamType == m.StreamTypePull {
 		channel.URL = url
 	}
+	if groupid := c.PostForm("groupid"); groupid == "-" {
+		channel.GroupID = ""
+	} else if groupid != "" {
+		if err := db.Get(db.DBClient, &sipapi.Groups{GroupID: groupid}); err != nil {
+			if db.RecordNotFound(err) {
+				m.JsonResponse(c, m.StatusParamsERR, "分组不存在")
+				return
+			}
+			m.JsonResponse(c, m.StatusDBERR, err)
+			return
+		}
+		channel.GroupID = groupid
+	}
 
 	if err := db.Save(db.DBClient, channel); err != nil {
 		m.JsonResponse(c, m.StatusDBERR, err)
@@ -189,9 +203,21 @@ func ChannelsDelete(c *gin.Context) {
 		m.JsonResponse(c, m.StatusDBERR, err)
 		return
 	}
-	if err := db.Del(db.DBClient, channel); err != nil {
+	tx, err := db.NewTx(db.DBClient)
+	if err != nil {
 		m.JsonResponse(c, m.StatusDBERR, err)
 		return
 	}
+	defer tx.End()
+	if err := db.Del(tx.DB(), channel); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	// 删除通道，同时取消向上级平台的共享
+	if err := db.Del(tx.DB(), &sipapi.PlatformChannels{ChannelID: channelid}); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	tx.Commit()
 	m.JsonResponse(c, m.StatusSucc, "")
 }
@@ -2,6 +2,8 @@ package api
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/panjjo/gorm"
@@ -65,14 +67,17 @@ func DevicesCreate(c *gin.Context) {
 // @Tags        devices
 // @Accept      x-www-form-urlencoded
 // @Produce     json
-// @Param       id   path     string true "设备id"
-// @Param       pwd  formData string false "设备密码(GB28181认证密码)"
-// @Param       name formData string false "设备名称"
-// @Success     0    {object} sipapi.Devices
-// @Failure     1000 {object} string
-// @Failure     1001 {object} string
-// @Failure     1002 {object} string
-// @Failure     1003 {object} string
+// @Param       id                path     string  true  "设备id"
+// @Param       pwd               formData string  false "设备密码(GB28181认证密码)"
+// @Param       name              formData string  false "设备名称"
+// @Param       keepaliveinterval formData integer false "心跳周期(秒)，0使用配置"
+// @Param       allowcidrs        formData string  false "允许注册的来源网段，多个逗号分隔，传-清除限制"
+// @Param       authalgorithms    formData string  false "允许的摘要算法，多个逗号分隔按优先级排列，传-使用配置"
+// @Success     0                 {object} sipapi.Devices
+// @Failure     1000              {object} string
+// @Failure     1001              {object} string
+// @Failure     1002              {object} string
+// @Failure     1003              {object} string
 // @Router      /devices/{id} [post]
 func DevicesUpdate(c *gin.Context) {
 	deviceid := c.Param("id")
@@ -97,10 +102,39 @@ func DevicesUpdate(c *gin.Context) {
 	if name != "" {
 		device.Name = name
 	}
+	if v := c.PostForm("keepaliveinterval"); v != "" {
+		interval, err := strconv.Atoi(v)
+		if err != nil || interval < 0 {
+			m.JsonResponse(c, m.StatusParamsERR, "心跳周期错误")
+			return
+		}
+		device.KeepaliveInterval = interval
+	}
+	if v := c.PostForm("allowcidrs"); v == "-" {
+		device.AllowCIDRs = ""
+	} else if v != "" {
+		cidrs, err := sipapi.ParseCIDRs(v)
+		if err != nil {
+			m.JsonResponse(c, m.StatusParamsERR, "网段格式错误")
+			return
+		}
+		device.AllowCIDRs = cidrs
+	}
+	if v := c.PostForm("authalgorithms"); v == "-" {
+		device.AuthAlgorithms = ""
+	} else if v != "" {
+		algorithms, err := sipapi.ParseAlgorithms(v)
+		if err != nil {
+			m.JsonResponse(c, m.StatusParamsERR, "摘要算法错误")
+			return
+		}
+		device.AuthAlgorithms = algorithms
+	}
 	if err := db.Save(db.DBClient, device); err != nil {
 		m.JsonResponse(c, m.StatusDBERR, err)
 		return
 	}
+	sipapi.SetKeepaliveInterval(device.DeviceID, device.KeepaliveInterval)
 	m.JsonResponse(c, m.StatusSucc, device)
 }
 
@@ -176,7 +210,22 @@ func DevicesDelete(c *gin.Context) {
 		m.JsonResponse(c, m.StatusDBERR, err)
 		return
 	}
-	// 删除设备，同时删除设备下的所有通道
+	// 删除设备，同时删除设备下的所有通道及通道共享
+	channels := []sipapi.Channels{}
+	if _, err := db.FindT(tx.DB(), new(sipapi.Channels), &channels, db.M{"deviceid=?": deviceid}, "", 0, -1, false); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	if len(channels) > 0 {
+		ids := make([]string, 0, len(channels))
+		for _, channel := range channels {
+			ids = append(ids, channel.ChannelID)
+		}
+		if err := db.DelQ(tx.DB(), new(sipapi.PlatformChannels), db.M{"channelid in (?)": ids}); err != nil {
+			m.JsonResponse(c, m.StatusDBERR, err)
+			return
+		}
+	}
 	if err := db.Del(tx.DB(), &sipapi.Channels{DeviceID: deviceid}); err != nil {
 		m.JsonResponse(c, m.StatusDBERR, err)
 		return
@@ -185,6 +234,169 @@ func DevicesDelete(c *gin.Context) {
 	m.JsonResponse(c, m.StatusSucc, "")
 }
 
+// @Summary     待审核设备审核接口
+// @Description 自动注册的待审核设备设置密码后审核通过，设备下次注册时完成认证
+// @Tags        devices
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id   path     string true  "设备id"
+// @Param       pwd  formData string true  "设备密码(GB28181认证密码)"
+// @Param       name formData string false "设备名称"
+// @Success     0    {object} sipapi.Devices
+// @Failure     1000 {object} string
+// @Failure     1001 {object} string
+// @Failure     1002 {object} string
+// @Failure     1003 {object} string
+// @Router      /devices/{id}/approve [post]
+func DevicesApprove(c *gin.Context) {
+	pwd := c.PostForm("pwd")
+	if pwd == "" {
+		m.JsonResponse(c, m.StatusParamsERR, "密码不能为空")
+		return
+	}
+	device := &sipapi.Devices{
+		DeviceID: c.Param("id"),
+	}
+	if err := db.Get(db.DBClient, device); err != nil {
+		if db.RecordNotFound(err) {
+			m.JsonResponse(c, m.StatusParamsERR, "设备id不存在")
+			return
+		}
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	if !device.Pending {
+		m.JsonResponse(c, m.StatusParamsERR, "设备不是待审核设备")
+		return
+	}
+	device.Pending = false
+	device.PWD = pwd
+	if name := c.PostForm("name"); name != "" {
+		device.Name = name
+	}
+	if err := db.Save(db.DBClient, device); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, device)
+}
+
+type DevicesImportResponse struct {
+	// Created 新增的设备
+	Created []string
+	// Approved 审核通过的待审核设备
+	Approved []string
+	// Exists 已存在的设备，不做修改
+	Exists []string
+}
+
+// @Summary     设备批量导入接口
+// @Description 使用设备出厂的20位国标编码批量新增设备，已存在的待审核设备直接审核通过
+// @Tags        devices
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       ids  formData string true "设备id，多个使用逗号或换行分隔"
+// @Param       pwd  formData string true "设备密码(GB28181认证密码)"
+// @Success     0    {object} DevicesImportResponse
+// @Failure     1000 {object} string
+// @Failure     1001 {object} string
+// @Failure     1002 {object} string
+// @Failure     1003 {object} string
+// @Router      /devices/import [post]
+func DevicesImport(c *gin.Context) {
+	pwd := c.PostForm("pwd")
+	if pwd == "" {
+		m.JsonResponse(c, m.StatusParamsERR, "密码不能为空")
+		return
+	}
+	ids := strings.FieldsFunc(c.PostForm("ids"), func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' '
+	})
+	if len(ids) == 0 {
+		m.JsonResponse(c, m.StatusParamsERR, "设备id不能为空")
+		return
+	}
+	for _, id := range ids {
+		if !sipapi.ValidDeviceID(id) {
+			m.JsonResponse(c, m.StatusParamsERR, fmt.Sprintf("设备id格式错误:%s", id))
+			return
+		}
+	}
+	tx, err := db.NewTx(db.DBClient)
+	if err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	defer tx.End()
+	res := DevicesImportResponse{Created: []string{}, Approved: []string{}, Exists: []string{}}
+	for _, id := range ids {
+		device := &sipapi.Devices{DeviceID: id}
+		err := db.Get(tx.DB(), device)
+		switch {
+		case err == nil && device.Pending:
+			device.Pending = false
+			device.PWD = pwd
+			if err := db.Save(tx.DB(), device); err != nil {
+				m.JsonResponse(c, m.StatusDBERR, err)
+				return
+			}
+			res.Approved = append(res.Approved, id)
+		case err == nil:
+			res.Exists = append(res.Exists, id)
+		case db.RecordNotFound(err):
+			device = &sipapi.Devices{
+				DeviceID: id,
+				Region:   m.MConfig.GB28181.Region,
+				PWD:      pwd,
+				Name:     id,
+			}
+			if err := db.Create(tx.DB(), device); err != nil {
+				m.JsonResponse(c, m.StatusDBERR, err)
+				return
+			}
+			res.Created = append(res.Created, id)
+		default:
+			m.JsonResponse(c, m.StatusDBERR, err)
+			return
+		}
+	}
+	tx.Commit()
+	m.JsonResponse(c, m.StatusSucc, res)
+}
+
+// @Summary     注册锁定列表
+// @Description 设备编号或来源IP多次注册认证失败的记录，lockeduntil大于当前时间为锁定中
+// @Tags        devices
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Success     0    {object} []sipapi.RegisterLockout
+// @Failure     1000 {object} string
+// @Failure     1001 {object} string
+// @Failure     1002 {object} string
+// @Failure     1003 {object} string
+// @Router      /devices/lockouts [get]
+func DevicesLockouts(c *gin.Context) {
+	m.JsonResponse(c, m.StatusSucc, sipapi.GetRegisterLockouts())
+}
+
+// @Summary     解除注册锁定
+// @Description 清除设备编号或来源IP的认证失败记录，均不传时清除全部
+// @Tags        devices
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       deviceid query    string false "设备id"
+// @Param       ip       query    string false "来源IP"
+// @Success     0        {object} string
+// @Failure     1000     {object} string
+// @Failure     1001     {object} string
+// @Failure     1002     {object} string
+// @Failure     1003     {object} string
+// @Router      /devices/lockouts [delete]
+func DevicesLockoutsClear(c *gin.Context) {
+	sipapi.ClearRegisterLockout(c.Query("deviceid"), c.Query("ip"))
+	m.JsonResponse(c, m.StatusSucc, "")
+}
+
 // // 视频流录制 默认保存为mp4文件，录制最多录制10分钟，10分钟后自动停止，一个流只能存在一个录制
 // func apiRecordStart(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 // 	id := ps.ByName("id")
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/panjjo/gosip/db"
+	"github.com/panjjo/gosip/m"
+	sipapi "github.com/panjjo/gosip/sip"
+)
+
+// @Summary     目录树
+// @Description 完整的业务分组、虚拟组织树，不包含通道，分组的channels为直属通道数
+// @Tags        groups
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Success     0    {object} []sipapi.TreeNode
+// @Failure     1000 {object} string
+// @Failure     1001 {object} string
+// @Failure     1002 {object} string
+// @Failure     1003 {object} string
+// @Router      /tree [get]
+func TreeList(c *gin.Context) {
+	tree, err := sipapi.GetTree()
+	if err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, tree)
+}
+
+// @Summary     目录树懒加载
+// @Description 返回分组的直属下级分组和通道，parentid为空时返回根节点
+// @Tags        groups
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       parentid query    string false "上级分组编码"
+// @Success     0        {object} []sipapi.TreeNode
+// @Failure     1000     {object} string
+// @Failure     1001     {object} string
+// @Failure     1002     {object} string
+// @Failure     1003     {object} string
+// @Router      /tree/nodes [get]
+func TreeNodes(c *gin.Context) {
+	nodes, err := sipapi.GetTreeChildren(c.Query("parentid"))
+	if err != nil {
+		if db.RecordNotFound(err) {
+			m.JsonResponse(c, m.StatusParamsERR, "分组不存在")
+			return
+		}
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, nodes)
+}
+
+// groupParent 校验上级分组，业务分组只能为根节点，上级不能为自身或下级分组
+func groupParent(c *gin.Context, group *sipapi.Groups, parentID string) bool {
+	if parentID == "" {
+		group.ParentID = ""
+		group.BusinessGroupID = ""
+		return true
+	}
+	if group.Type == sipapi.GroupTypeBusiness {
+		m.JsonResponse(c, m.StatusParamsERR, "业务分组不能设置上级")
+		return false
+	}
+	parent := &sipapi.Groups{GroupID: parentID}
+	if err := db.Get(db.DBClient, parent); err != nil {
+		if db.RecordNotFound(err) {
+			m.JsonResponse(c, m.StatusParamsERR, "上级分组不存在")
+			return false
+		}
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return false
+	}
+	visited := map[string]bool{}
+	for p := *parent; !visited[p.GroupID]; {
+		visited[p.GroupID] = true
+		if p.GroupID == group.GroupID {
+			m.JsonResponse(c, m.StatusParamsERR, "上级分组不能为自身或下级分组")
+			return false
+		}
+		if p.ParentID == "" {
+			break
+		}
+		next := sipapi.Groups{GroupID: p.ParentID}
+		if err := db.Get(db.DBClient, &next); err != nil {
+			break
+		}
+		p = next
+	}
+	group.ParentID = parent.GroupID
+	if parent.Type == sipapi.GroupTypeBusiness {
+		group.BusinessGroupID = parent.GroupID
+	} else {
+		group.BusinessGroupID = parent.BusinessGroupID
+	}
+	return true
+}
+
+// @Summary     分组新增接口
+// @Description 新增业务分组或虚拟组织，编码第11~13位为215业务分组，216虚拟组织
+// @Tags        groups
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       groupid  formData string true  "20位分组编码"
+// @Param       name     formData string true  "分组名称"
+// @Param       parentid formData string false "上级分组编码，虚拟组织可设置"
+// @Success     0        {object} sipapi.Groups
+// @Failure     1000     {object} string
+// @Failure     1001     {object} string
+// @Failure     1002     {object} string
+// @Failure     1003     {object} string
+// @Router      /groups [post]
+func GroupsCreate(c *gin.Context) {
+	group := &sipapi.Groups{GroupID: c.PostForm("groupid"), Name: c.PostForm("name")}
+	if !sipapi.IsGroupID(group.GroupID) {
+		m.JsonResponse(c, m.StatusParamsERR, "分组编码必须为215或216类型的20位国标编码")
+		return
+	}
+	if group.Name == "" {
+		m.JsonResponse(c, m.StatusParamsERR, "分组名称不能为空")
+		return
+	}
+	if err := db.Get(db.DBClient, &sipapi.Groups{GroupID: group.GroupID}); err == nil {
+		m.JsonResponse(c, m.StatusParamsERR, "分组编码已存在")
+		return
+	} else if !db.RecordNotFound(err) {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	group.Type = sipapi.GroupType(group.GroupID)
+	if !groupParent(c, group, c.PostForm("parentid")) {
+		return
+	}
+	if err := db.Create(db.DBClient, group); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, group)
+}
+
+// @Summary     分组修改接口
+// @Description 修改分组名称或移动到其他上级分组
+// @Tags        groups
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id       path     string true  "分组编码"
+// @Param       name     formData string false "分组名称"
+// @Param       parentid formData string false "上级分组编码，传-移动到根节点"
+// @Success     0        {object} sipapi.Groups
+// @Failure     1000     {object} string
+// @Failure     1001     {object} string
+// @Failure     1002     {object} string
+// @Failure     1003     {object} string
+// @Router      /groups/{id} [post]
+func GroupsUpdate(c *gin.Context) {
+	group := &sipapi.Groups{GroupID: c.Param("id")}
+	if err := db.Get(db.DBClient, group); err != nil {
+		if db.RecordNotFound(err) {
+			m.JsonResponse(c, m.StatusParamsERR, "分组不存在")
+			return
+		}
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	if name := c.PostForm("name"); name != "" {
+		group.Name = name
+	}
+	if parentID := c.PostForm("parentid"); parentID == "-" {
+		groupParent(c, group, "")
+	} else if parentID != "" && !groupParent(c, group, parentID) {
+		return
+	}
+	if err := db.Save(db.DBClient, group); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, group)
+}
+
+// @Summary     分组删除接口
+// @Description 删除分组，下级分组移动到被删除分组的上级，分组下通道移出分组
+// @Tags        groups
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id   path     string true "分组编码"
+// @Success     0    {object} string
+// @Failure     1000 {object} string
+// @Failure     1001 {object} string
+// @Failure     1002 {object} string
+// @Failure     1003 {object} string
+// @Router      /groups/{id} [delete]
+func GroupsDelete(c *gin.Context) {
+	if err := sipapi.DeleteGroup(c.Param("id")); err != nil {
+		if db.RecordNotFound(err) {
+			m.JsonResponse(c, m.StatusParamsERR, "分组不存在")
+			return
+		}
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, "")
+}
+
+// @Summary     分组通道分配接口
+// @Description 将通道分配到分组，通道原所属分组失效
+// @Tags        groups
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id         path     string true "分组编码"
+// @Param       channelids formData string true "通道id，多个使用逗号分隔"
+// @Success     0          {object} string
+// @Failure     1000       {object} string
+// @Failure     1001       {object} string
+// @Failure     1002       {object} string
+// @Failure     1003       {object} string
+// @Router      /groups/{id}/channels [post]
+func GroupsChannels(c *gin.Context) {
+	group := &sipapi.Groups{GroupID: c.Param("id")}
+	if err := db.Get(db.DBClient, group); err != nil {
+		if db.RecordNotFound(err) {
+			m.JsonResponse(c, m.StatusParamsERR, "分组不存在")
+			return
+		}
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	ids := strings.FieldsFunc(c.PostForm("channelids"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n'
+	})
+	if len(ids) == 0 {
+		m.JsonResponse(c, m.StatusParamsERR, "缺少通道ID")
+		return
+	}
+	if _, err := db.UpdateAll(db.DBClient, new(sipapi.Channels), db.M{"channelid in (?)": ids}, db.M{"groupid": group.GroupID}); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, "")
+}
@@ -0,0 +1,318 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/panjjo/gosip/db"
+	"github.com/panjjo/gosip/m"
+	sipapi "github.com/panjjo/gosip/sip"
+)
+
+// @Summary     上级平台列表
+// @Description 配置的级联上级平台及注册、心跳状态
+// @Tags        platforms
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Success     0    {object} []sipapi.PlatformStatus
+// @Failure     1000 {object} string
+// @Failure     1001 {object} string
+// @Failure     1002 {object} string
+// @Failure     1003 {object} string
+// @Router      /platforms [get]
+func PlatformsList(c *gin.Context) {
+	m.JsonResponse(c, m.StatusSucc, sipapi.GetPlatforms())
+}
+
+// platformParam 路径中的上级平台编码，未配置的平台返回错误
+func platformParam(c *gin.Context) (string, bool) {
+	id := c.Param("id")
+	if !sipapi.HasPlatform(id) {
+		m.JsonResponse(c, m.StatusParamsERR, "上级平台不存在")
+		return "", false
+	}
+	return id, true
+}
+
+// platformShareExists 上级平台下通道编码或共享编码是否已使用
+func platformShareExists(platformID string, query db.M) (bool, error) {
+	query["platformid=?"] = platformID
+	err := db.GetQ(db.DBClient, &sipapi.PlatformChannels{}, query)
+	if err == nil {
+		return true, nil
+	}
+	if db.RecordNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+type PlatformChannelsListResponse struct {
+	Total int64
+	List  []sipapi.PlatformChannels
+}
+
+// @Summary     上级平台共享通道列表
+// @Description 共享给上级平台的通道，上级平台目录查询只返回这些通道
+// @Tags        platforms
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id    path     string  true  "上级平台编码"
+// @Param       limit query    integer false "条数(0-100) 默认20"
+// @Param       skip  query    integer false "间隔 默认0"
+// @Param       sort  query    string  false "排序,例:-key,根据key倒序,key,根据key正序"
+// @Success     0     {object} PlatformChannelsListResponse
+// @Failure     1000  {object} string
+// @Failure     1001  {object} string
+// @Failure     1002  {object} string
+// @Failure     1003  {object} string
+// @Router      /platforms/{id}/channels [get]
+func PlatformChannelsList(c *gin.Context) {
+	id, ok := platformParam(c)
+	if !ok {
+		return
+	}
+	list := []sipapi.PlatformChannels{}
+	total, err := db.FindT(db.DBClient, new(sipapi.PlatformChannels), &list, db.M{"platformid=?": id}, m.GetSort(c), m.GetSkip(c), m.GetLimit(c), true)
+	if err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, PlatformChannelsListResponse{
+		Total: total,
+		List:  list,
+	})
+}
+
+// @Summary     上级平台共享通道新增
+// @Description 共享通道给上级平台，可指定上级平台看到的通道编码和名称
+// @Tags        platforms
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id        path     string true  "上级平台编码"
+// @Param       channelid formData string true  "通道id"
+// @Param       shareid   formData string false "上级平台看到的20位通道编码，默认与通道id相同"
+// @Param       name      formData string false "上级平台看到的通道名称，默认使用通道名称"
+// @Success     0         {object} sipapi.PlatformChannels
+// @Failure     1000      {object} string
+// @Failure     1001      {object} string
+// @Failure     1002      {object} string
+// @Failure     1003      {object} string
+// @Router      /platforms/{id}/channels [post]
+func PlatformChannelsCreate(c *gin.Context) {
+	id, ok := platformParam(c)
+	if !ok {
+		return
+	}
+	channel := &sipapi.Channels{ChannelID: c.PostForm("channelid")}
+	if channel.ChannelID == "" {
+		m.JsonResponse(c, m.StatusParamsERR, "缺少通道ID")
+		return
+	}
+	if err := db.Get(db.DBClient, channel); err != nil {
+		if db.RecordNotFound(err) {
+			m.JsonResponse(c, m.StatusParamsERR, "通道id不存在")
+			return
+		}
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	share := &sipapi.PlatformChannels{
+		PlatformID: id,
+		ChannelID:  channel.ChannelID,
+		ShareID:    c.PostForm("shareid"),
+		Name:       c.PostForm("name"),
+	}
+	if share.ShareID == "" {
+		share.ShareID = channel.ChannelID
+	} else if !sipapi.ValidDeviceID(share.ShareID) {
+		m.JsonResponse(c, m.StatusParamsERR, "共享编码必须为20位国标编码")
+		return
+	}
+	exists, err := platformShareExists(id, db.M{"channelid=?": share.ChannelID})
+	if err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	if exists {
+		m.JsonResponse(c, m.StatusParamsERR, "通道已共享给该平台")
+		return
+	}
+	if exists, err = platformShareExists(id, db.M{"shareid=?": share.ShareID}); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	if exists {
+		m.JsonResponse(c, m.StatusParamsERR, "共享编码已被使用")
+		return
+	}
+	if err := db.Create(db.DBClient, share); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, share)
+}
+
+// @Summary     上级平台共享通道修改
+// @Description 修改上级平台看到的通道编码和名称
+// @Tags        platforms
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id      path     string true  "上级平台编码"
+// @Param       shareid path     string true  "共享编码"
+// @Param       newid   formData string false "新的20位共享编码"
+// @Param       name    formData string false "上级平台看到的通道名称，传-恢复使用通道名称"
+// @Success     0       {object} sipapi.PlatformChannels
+// @Failure     1000    {object} string
+// @Failure     1001    {object} string
+// @Failure     1002    {object} string
+// @Failure     1003    {object} string
+// @Router      /platforms/{id}/channels/{shareid} [post]
+func PlatformChannelsUpdate(c *gin.Context) {
+	id, ok := platformParam(c)
+	if !ok {
+		return
+	}
+	share := &sipapi.PlatformChannels{PlatformID: id, ShareID: c.Param("shareid")}
+	if err := db.Get(db.DBClient, share); err != nil {
+		if db.RecordNotFound(err) {
+			m.JsonResponse(c, m.StatusParamsERR, "共享通道不存在")
+			return
+		}
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	if newid := c.PostForm("newid"); newid != "" && newid != share.ShareID {
+		if !sipapi.ValidDeviceID(newid) {
+			m.JsonResponse(c, m.StatusParamsERR, "共享编码必须为20位国标编码")
+			return
+		}
+		exists, err := platformShareExists(id, db.M{"shareid=?": newid})
+		if err != nil {
+			m.JsonResponse(c, m.StatusDBERR, err)
+			return
+		}
+		if exists {
+			m.JsonResponse(c, m.StatusParamsERR, "共享编码已被使用")
+			return
+		}
+		share.ShareID = newid
+	}
+	if name := c.PostForm("name"); name == "-" {
+		share.Name = ""
+	} else if name != "" {
+		share.Name = name
+	}
+	if err := db.Save(db.DBClient, share); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, share)
+}
+
+// @Summary     上级平台共享通道删除
+// @Description 取消共享，上级平台不再能查询和点播该通道
+// @Tags        platforms
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id      path     string true "上级平台编码"
+// @Param       shareid path     string true "共享编码"
+// @Success     0       {object} string
+// @Failure     1000    {object} string
+// @Failure     1001    {object} string
+// @Failure     1002    {object} string
+// @Failure     1003    {object} string
+// @Router      /platforms/{id}/channels/{shareid} [delete]
+func PlatformChannelsDelete(c *gin.Context) {
+	id, ok := platformParam(c)
+	if !ok {
+		return
+	}
+	share := &sipapi.PlatformChannels{PlatformID: id, ShareID: c.Param("shareid")}
+	if err := db.Get(db.DBClient, share); err != nil {
+		if db.RecordNotFound(err) {
+			m.JsonResponse(c, m.StatusParamsERR, "共享通道不存在")
+			return
+		}
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	if err := db.Del(db.DBClient, share); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, "")
+}
+
+type PlatformChannelsAssignResponse struct {
+	// Created 新共享的通道
+	Created []string
+	// Exists 已共享或共享编码已被使用的通道，不做修改
+	Exists []string
+}
+
+// @Summary     上级平台批量共享通道
+// @Description 按设备或行政区划批量共享通道，共享编码与通道id相同
+// @Tags        platforms
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id        path     string true  "上级平台编码"
+// @Param       deviceid  formData string false "设备id，共享设备下全部通道"
+// @Param       civilcode formData string false "行政区划，共享以此编码开头的全部通道"
+// @Success     0         {object} PlatformChannelsAssignResponse
+// @Failure     1000      {object} string
+// @Failure     1001      {object} string
+// @Failure     1002      {object} string
+// @Failure     1003      {object} string
+// @Router      /platforms/{id}/channels/bulk [post]
+func PlatformChannelsAssign(c *gin.Context) {
+	id, ok := platformParam(c)
+	if !ok {
+		return
+	}
+	query := db.M{}
+	if v := c.PostForm("deviceid"); v != "" {
+		query["deviceid=?"] = v
+	}
+	if v := c.PostForm("civilcode"); v != "" {
+		query["civilcode like ?"] = v + "%"
+	}
+	if len(query) == 0 {
+		m.JsonResponse(c, m.StatusParamsERR, "设备id和行政区划不能同时为空")
+		return
+	}
+	channels := []sipapi.Channels{}
+	if _, err := db.FindT(db.DBClient, new(sipapi.Channels), &channels, query, "", 0, -1, false); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	shares := []sipapi.PlatformChannels{}
+	if _, err := db.FindT(db.DBClient, new(sipapi.PlatformChannels), &shares, db.M{"platformid=?": id}, "", 0, -1, false); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	used := map[string]bool{}
+	for _, share := range shares {
+		used[share.ChannelID] = true
+		used[share.ShareID] = true
+	}
+	tx, err := db.NewTx(db.DBClient)
+	if err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	defer tx.End()
+	res := PlatformChannelsAssignResponse{Created: []string{}, Exists: []string{}}
+	for _, channel := range channels {
+		if used[channel.ChannelID] {
+			res.Exists = append(res.Exists, channel.ChannelID)
+			continue
+		}
+		if err := db.Create(tx.DB(), &sipapi.PlatformChannels{PlatformID: id, ChannelID: channel.ChannelID, ShareID: channel.ChannelID}); err != nil {
+			m.JsonResponse(c, m.StatusDBERR, err)
+			return
+		}
+		used[channel.ChannelID] = true
+		res.Created = append(res.Created, channel.ChannelID)
+	}
+	tx.Commit()
+	m.JsonResponse(c, m.StatusSucc, res)
+}
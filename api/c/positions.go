@@ -0,0 +1,48 @@
+package api
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/panjjo/gosip/db"
+	"github.com/panjjo/gosip/m"
+	sipapi "github.com/panjjo/gosip/sip"
+)
+
+// @Summary     通道位置轨迹
+// @Description 获取移动设备通道时间段内的位置历史，按时间正序返回，用于轨迹回放，时间跨度最多7天
+// @Tags        channels
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id    path     string true "通道id"
+// @Param       start query    int    true "开始时间，时间戳"
+// @Param       end   query    int    true "结束时间，时间戳"
+// @Success     0     {object} []sipapi.Positions
+// @Failure     1000  {object} string
+// @Failure     1001  {object} string
+// @Failure     1002  {object} string
+// @Failure     1003  {object} string
+// @Router      /channels/{id}/positions [get]
+func PositionsList(c *gin.Context) {
+	channelid := c.Param("id")
+	start, err := strconv.ParseInt(c.Query("start"), 10, 64)
+	if err != nil || start <= 0 {
+		m.JsonResponse(c, m.StatusParamsERR, "开始时间错误")
+		return
+	}
+	end, err := strconv.ParseInt(c.Query("end"), 10, 64)
+	if err != nil || end <= start {
+		m.JsonResponse(c, m.StatusParamsERR, "结束时间错误")
+		return
+	}
+	if end-start > 7*86400 {
+		m.JsonResponse(c, m.StatusParamsERR, "时间跨度不能超过7天")
+		return
+	}
+	positions := []sipapi.Positions{}
+	if _, err := db.FindT(db.DBClient, new(sipapi.Positions), &positions, db.M{"channelid=?": channelid, "time>=?": start, "time<=?": end}, "time", 0, -1, false); err != nil {
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, positions)
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/panjjo/gosip/db"
+	"github.com/panjjo/gosip/m"
+	sipapi "github.com/panjjo/gosip/sip"
+)
+
+// getOnlineChannel 获取在线通道，失败时直接返回错误响应
+func getOnlineChannel(c *gin.Context) (*sipapi.Channels, bool) {
+	channel := &sipapi.Channels{ChannelID: c.Param("id")}
+	if err := db.Get(db.DBClient, channel); err != nil {
+		if db.RecordNotFound(err) {
+			m.JsonResponse(c, m.StatusParamsERR, "通道不存在")
+			return nil, false
+		}
+		m.JsonResponse(c, m.StatusDBERR, err)
+		return nil, false
+	}
+	if channel.Status != m.DeviceStatusON {
+		m.JsonResponse(c, m.StatusParamsERR, "通道已离线")
+		return nil, false
+	}
+	return channel, true
+}
+
+// @Summary     云台控制
+// @Description 控制通道云台转动和镜头变倍，direction和zoom都为空时停止
+// @Tags        ptz
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id        path     string  true  "通道id"
+// @Param       direction formData string  false "转动方向 up,down,left,right,upleft,upright,downleft,downright,stop"
+// @Param       zoom      formData string  false "变倍 in 放大，out 缩小，stop"
+// @Param       speed     formData integer false "速度 0-255，默认128"
+// @Success     0         {object} string
+// @Failure     1000      {object} string
+// @Failure     1001      {object} string
+// @Failure     1002      {object} string
+// @Failure     1003      {object} string
+// @Router      /channels/{id}/ptz [post]
+func PTZControl(c *gin.Context) {
+	ptz := sipapi.PTZControl{
+		Direction: c.PostForm("direction"),
+		Zoom:      c.PostForm("zoom"),
+	}
+	speed, err := formInt(c, "speed", 128)
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, "速度参数错误")
+		return
+	}
+	ptz.Speed = speed
+	channel, ok := getOnlineChannel(c)
+	if !ok {
+		return
+	}
+	if err := sipapi.SipPTZ(c.Request.Context(), channel, ptz); err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, err.Error())
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, "")
+}
+
+// formInt 获取整数表单参数，未传时返回默认值
+func formInt(c *gin.Context, key string, def int) (int, error) {
+	v := c.PostForm(key)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// @Summary     预置位列表
+// @Description 向设备查询通道的预置位列表（最多10s）
+// @Tags        ptz
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id   path     string true "通道id"
+// @Success     0    {object} []sipapi.Preset
+// @Failure     1000 {object} string
+// @Failure     1001 {object} string
+// @Failure     1002 {object} string
+// @Failure     1003 {object} string
+// @Router      /channels/{id}/presets [get]
+func PresetsList(c *gin.Context) {
+	channel, ok := getOnlineChannel(c)
+	if !ok {
+		return
+	}
+	res, err := sipapi.SipPresetQuery(c.Request.Context(), channel)
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, err.Error())
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, res)
+}
+
+// @Summary     预置位控制
+// @Description 设置、调用、删除预置位
+// @Tags        ptz
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id       path     string  true "通道id"
+// @Param       action   formData string  true "操作 set 设置，call 调用，delete 删除"
+// @Param       presetid formData integer true "预置位编号 1-255"
+// @Success     0        {object} string
+// @Failure     1000     {object} string
+// @Failure     1001     {object} string
+// @Failure     1002     {object} string
+// @Failure     1003     {object} string
+// @Router      /channels/{id}/presets [post]
+func PresetControl(c *gin.Context) {
+	presetID, err := formInt(c, "presetid", 0)
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, "预置位编号错误")
+		return
+	}
+	channel, ok := getOnlineChannel(c)
+	if !ok {
+		return
+	}
+	if err := sipapi.SipPreset(c.Request.Context(), channel, c.PostForm("action"), presetID); err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, err.Error())
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, "")
+}
+
+// @Summary     巡航控制
+// @Description 巡航轨迹添加、删除巡航点，设置巡航速度、停留时间，开始、停止巡航
+// @Tags        ptz
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id       path     string  true  "通道id"
+// @Param       cruiseid path     integer true  "巡航组号 0-255"
+// @Param       action   formData string  true  "操作 add 加入巡航点，delete 删除巡航点，speed 设置速度，dwell 设置停留时间，start 开始，stop 停止"
+// @Param       presetid formData integer false "预置位编号，add/delete时生效，delete时为0删除整条巡航"
+// @Param       value    formData integer false "速度或停留时间(秒)，speed/dwell时生效，0-4095"
+// @Success     0        {object} string
+// @Failure     1000     {object} string
+// @Failure     1001     {object} string
+// @Failure     1002     {object} string
+// @Failure     1003     {object} string
+// @Router      /channels/{id}/cruises/{cruiseid} [post]
+func CruiseControl(c *gin.Context) {
+	cruiseID, err := strconv.Atoi(c.Param("cruiseid"))
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, "巡航组号错误")
+		return
+	}
+	presetID, err := formInt(c, "presetid", 0)
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, "预置位编号错误")
+		return
+	}
+	value, err := formInt(c, "value", 0)
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, "参数值错误")
+		return
+	}
+	channel, ok := getOnlineChannel(c)
+	if !ok {
+		return
+	}
+	if err := sipapi.SipCruise(c.Request.Context(), channel, c.PostForm("action"), cruiseID, presetID, value); err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, err.Error())
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, "")
+}
+
+// @Summary     自动扫描控制
+// @Description 设置自动扫描左右边界、速度，开始、停止扫描
+// @Tags        ptz
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id     path     string  true  "通道id"
+// @Param       scanid path     integer true  "扫描组号 0-255"
+// @Param       action formData string  true  "操作 start 开始，left 设置左边界，right 设置右边界，speed 设置速度，stop 停止"
+// @Param       value  formData integer false "扫描速度，speed时生效，0-4095"
+// @Success     0      {object} string
+// @Failure     1000   {object} string
+// @Failure     1001   {object} string
+// @Failure     1002   {object} string
+// @Failure     1003   {object} string
+// @Router      /channels/{id}/scans/{scanid} [post]
+func ScanControl(c *gin.Context) {
+	scanID, err := strconv.Atoi(c.Param("scanid"))
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, "扫描组号错误")
+		return
+	}
+	value, err := formInt(c, "value", 0)
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, "参数值错误")
+		return
+	}
+	channel, ok := getOnlineChannel(c)
+	if !ok {
+		return
+	}
+	if err := sipapi.SipScan(c.Request.Context(), channel, c.PostForm("action"), scanID, value); err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, err.Error())
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, "")
+}
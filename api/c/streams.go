@@ -11,16 +11,18 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// @Summary     监控播放（直播/回放）
+// @Summary     监控播放（直播/回放/下载）
 // @Description 直播一个通道最多存在一个流，回放每请求一次生成一个流
 // @Tags        streams
 // @Accept      x-www-form-urlencoded
 // @Produce     json
-// @Param       id     path     string true  "通道id"
-// @Param       replay formData int    false "是否回放，1回放，0直播，默认0"
-// @Param       start  formData int    false "回放开始时间，时间戳，replay=1时必传"
-// @Param       end    formData int    false "回放结束时间，时间戳，replay=1时必传"
-// @Success     0      {object} sipapi.Streams
+// @Param       id       path     string true  "通道id"
+// @Param       replay   formData int    false "是否回放，1回放，0直播，默认0"
+// @Param       start    formData int    false "回放开始时间，时间戳，replay=1时必传"
+// @Param       end      formData int    false "回放结束时间，时间戳，replay=1时必传"
+// @Param       download formData int    false "是否下载录像，1下载，需同时传replay=1"
+// @Param       speed    formData int    false "下载倍速，download=1时生效，默认4"
+// @Success     0        {object} sipapi.Streams
 // @Failure     1000 {object} string
 // @Failure     1001 {object} string
 // @Failure     1002 {object} string
@@ -44,6 +46,19 @@ func Play(c *gin.Context) {
 			m.JsonResponse(c, m.StatusParamsERR, "开始时间>=结束时间")
 			return
 		}
+		if c.PostForm("download") == "1" {
+			// 下载
+			pm.T = 2
+			speed := 4
+			if v := c.PostForm("speed"); v != "" {
+				speed, _ = strconv.Atoi(v)
+			}
+			if speed < 1 || speed > 64 {
+				m.JsonResponse(c, m.StatusParamsERR, "下载倍速错误")
+				return
+			}
+			pm.Scale = float64(speed)
+		}
 	} else {
 		// 直播 判断当前通道是否存在流了。
 		if succ, ok := sipapi.StreamList.Succ.Load(channelid); ok {
@@ -51,7 +66,7 @@ func Play(c *gin.Context) {
 			return
 		}
 	}
-	res, err := sipapi.SipPlay(pm)
+	res, err := sipapi.SipPlay(c.Request.Context(), pm)
 	if err != nil {
 		m.JsonResponse(c, m.StatusParamsERR, err.Error())
 		return
@@ -117,3 +132,120 @@ func StreamsList(c *gin.Context) {
 		List:  streams,
 	})
 }
+
+// @Summary     暂停回放
+// @Description 暂停设备推流的回放
+// @Tags        streams
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id   path     string true "流id,播放接口返回的streamid"
+// @Success     0    {object} sipapi.PlaybackState
+// @Failure     1000 {object} string
+// @Failure     1001 {object} string
+// @Failure     1002 {object} string
+// @Failure     1003 {object} string
+// @Router      /streams/{id}/pause [post]
+func PlaybackPause(c *gin.Context) {
+	res, err := sipapi.SipPlaybackPause(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, err.Error())
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, res)
+}
+
+// @Summary     恢复回放
+// @Description 从暂停处恢复回放
+// @Tags        streams
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id   path     string true "流id,播放接口返回的streamid"
+// @Success     0    {object} sipapi.PlaybackState
+// @Failure     1000 {object} string
+// @Failure     1001 {object} string
+// @Failure     1002 {object} string
+// @Failure     1003 {object} string
+// @Router      /streams/{id}/resume [post]
+func PlaybackResume(c *gin.Context) {
+	res, err := sipapi.SipPlaybackResume(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, err.Error())
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, res)
+}
+
+// @Summary     回放跳转
+// @Description 跳转到指定回放位置
+// @Tags        streams
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id       path     string  true "流id,播放接口返回的streamid"
+// @Param       position formData integer true "跳转位置，相对回放开始时间的秒数"
+// @Success     0        {object} sipapi.PlaybackState
+// @Failure     1000     {object} string
+// @Failure     1001     {object} string
+// @Failure     1002     {object} string
+// @Failure     1003     {object} string
+// @Router      /streams/{id}/seek [post]
+func PlaybackSeek(c *gin.Context) {
+	pos, err := strconv.ParseInt(c.PostForm("position"), 10, 64)
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, "跳转位置错误")
+		return
+	}
+	res, err := sipapi.SipPlaybackSeek(c.Request.Context(), c.Param("id"), pos)
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, err.Error())
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, res)
+}
+
+// @Summary     回放倍速
+// @Description 设置回放倍速
+// @Tags        streams
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id    path     string true "流id,播放接口返回的streamid"
+// @Param       scale formData number true "倍速 0.25,0.5,1,2,4"
+// @Success     0     {object} sipapi.PlaybackState
+// @Failure     1000  {object} string
+// @Failure     1001  {object} string
+// @Failure     1002  {object} string
+// @Failure     1003  {object} string
+// @Router      /streams/{id}/scale [post]
+func PlaybackScale(c *gin.Context) {
+	scale, err := strconv.ParseFloat(c.PostForm("scale"), 64)
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, "倍速参数错误")
+		return
+	}
+	res, err := sipapi.SipPlaybackScale(c.Request.Context(), c.Param("id"), scale)
+	if err != nil {
+		m.JsonResponse(c, m.StatusParamsERR, err.Error())
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, res)
+}
+
+// @Summary     录像下载进度
+// @Description 获取下载流的进度，下载完成后通过fileid在文件列表中获取文件
+// @Tags        streams
+// @Accept      x-www-form-urlencoded
+// @Produce     json
+// @Param       id   path     string true "流id,播放接口返回的streamid"
+// @Success     0    {object} sipapi.DownloadProgress
+// @Failure     1000 {object} string
+// @Failure     1001 {object} string
+// @Failure     1002 {object} string
+// @Failure     1003 {object} string
+// @Router      /streams/{id}/progress [get]
+func DownloadProgress(c *gin.Context) {
+	res, ok := sipapi.GetDownloadProgress(c.Param("id"))
+	if !ok {
+		m.JsonResponse(c, m.StatusParamsERR, "下载流不存在")
+		return
+	}
+	m.JsonResponse(c, m.StatusSucc, res)
+}
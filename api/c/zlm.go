@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -100,6 +101,8 @@ func zlmStreamChanged(c *gin.Context) {
 				params.Stream = true
 				db.Save(db.DBClient, params)
 				sipapi.StreamList.Response.Store(ssrc, params)
+				// 录像下载开始录制文件
+				sipapi.StartDownloadRecord(params)
 				// 接收到流注册后进行视频流编码分析，分析出此设备对应的编码格式并保存或更新
 				sipapi.SyncDevicesCodec(ssrc, params.DeviceID)
 			} else {
@@ -204,7 +207,9 @@ func zlmStreamNotFound(c *gin.Context) {
 				logrus.Infoln("closeStream stream pushed!", req.Stream)
 			} else {
 				// 拉流的，重新拉流
-				sipapi.SipPlay(params)
+				ctx, cancel := context.WithTimeout(context.Background(), sipapi.PlayTimeout)
+				sipapi.SipPlay(ctx, params)
+				cancel()
 				logrus.Infoln("closeStream stream pulled!", req.Stream)
 			}
 		} else {
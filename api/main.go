@@ -17,6 +17,10 @@ func Init(r *gin.Engine) {
 		r.POST("/devices", api.DevicesCreate)
 		r.POST("/devices/:id", api.DevicesUpdate)
 		r.DELETE("/devices/:id", api.DevicesDelete)
+		r.POST("/devices/:id/approve", api.DevicesApprove)
+		r.POST("/devices/import", api.DevicesImport)
+		r.GET("/devices/lockouts", api.DevicesLockouts)
+		r.DELETE("/devices/lockouts", api.DevicesLockoutsClear)
 
 	}
 	// 通道类接口
@@ -25,16 +29,54 @@ func Init(r *gin.Engine) {
 		r.POST("/devices/:id/channels", api.ChannelCreate)
 		r.POST("/channels/:id", api.ChannelsUpdate)
 		r.DELETE("/channels/:id", api.ChannelsDelete)
+		r.GET("/channels/:id/positions", api.PositionsList)
+	}
+	// 目录树类接口
+	{
+		r.GET("/tree", api.TreeList)
+		r.GET("/tree/nodes", api.TreeNodes)
+		r.POST("/groups", api.GroupsCreate)
+		r.POST("/groups/:id", api.GroupsUpdate)
+		r.DELETE("/groups/:id", api.GroupsDelete)
+		r.POST("/groups/:id/channels", api.GroupsChannels)
 	}
 	// 播放类接口
 	{
 		r.GET("/streams", api.StreamsList)
 		r.POST("/channels/:id/streams", api.Play)
 		r.DELETE("/streams/:id", api.Stop)
+		r.POST("/streams/:id/pause", api.PlaybackPause)
+		r.POST("/streams/:id/resume", api.PlaybackResume)
+		r.POST("/streams/:id/seek", api.PlaybackSeek)
+		r.POST("/streams/:id/scale", api.PlaybackScale)
+		r.GET("/streams/:id/progress", api.DownloadProgress)
 	}
 	// 录像类
 	{
 		r.GET("/channels/:id/records", api.RecordsList)
+		r.GET("/files", api.FilesList)
+	}
+	// 云台控制类
+	{
+		r.POST("/channels/:id/ptz", api.PTZControl)
+		r.GET("/channels/:id/presets", api.PresetsList)
+		r.POST("/channels/:id/presets", api.PresetControl)
+		r.POST("/channels/:id/cruises/:cruiseid", api.CruiseControl)
+		r.POST("/channels/:id/scans/:scanid", api.ScanControl)
+	}
+	// 报警类
+	{
+		r.GET("/alarms", api.AlarmsList)
+		r.POST("/devices/:id/alarms/reset", api.AlarmReset)
+	}
+	// 级联类
+	{
+		r.GET("/platforms", api.PlatformsList)
+		r.GET("/platforms/:id/channels", api.PlatformChannelsList)
+		r.POST("/platforms/:id/channels", api.PlatformChannelsCreate)
+		r.POST("/platforms/:id/channels/bulk", api.PlatformChannelsAssign)
+		r.POST("/platforms/:id/channels/:shareid", api.PlatformChannelsUpdate)
+		r.DELETE("/platforms/:id/channels/:shareid", api.PlatformChannelsDelete)
 	}
 	// zlm webhook
 	{
@@ -16,22 +16,97 @@ type Config struct {
 	DB        db.Config         `json:"database" yaml:"database" mapstructure:"database"`
 	LogLevel  string            `json:"logger" yaml:"logger" mapstructure:"logger"`
 	UDP       string            `json:"udp" yaml:"udp" mapstructure:"udp"`
+	TCP       string            `json:"tcp" yaml:"tcp" mapstructure:"tcp"`
+	TLS       TLSCfg            `json:"tls" yaml:"tls" mapstructure:"tls"`
+	Timer     TimerCfg          `json:"timer" yaml:"timer" mapstructure:"timer"`
 	API       string            `json:"api" yaml:"api" mapstructure:"api"`
 	Secret    string            `json:"secret" yaml:"secret" mapstructure:"secret"`
 	Media     MediaServer       `json:"media" yaml:"media" mapstructure:"media"`
 	Stream    Stream            `json:"stream" yaml:"stream" mapstructure:"stream"`
 	Record    RecordCfg         `json:"record" yaml:"record" mapstructure:"record"`
+	Subscribe SubscribeCfg      `json:"subscribe" yaml:"subscribe" mapstructure:"subscribe"`
+	Keepalive KeepaliveCfg      `json:"keepalive" yaml:"keepalive" mapstructure:"keepalive"`
+	Auth      AuthCfg           `json:"auth" yaml:"auth" mapstructure:"auth"`
+	Cascade   []CascadeCfg      `json:"cascade" yaml:"cascade" mapstructure:"cascade"`
 	GB28181   *SysInfo          `json:"gb28181" yaml:"gb28181" mapstructure:"gb28181"`
 	Notify    map[string]string `json:"notify" yaml:"notify" mapstructure:"notify"`
 	NotifyMap map[string]string
 }
 
+// TLSCfg sips 监听配置
+type TLSCfg struct {
+	Addr string `json:"addr" yaml:"addr" mapstructure:"addr"`
+	Cert string `json:"cert" yaml:"cert" mapstructure:"cert"`
+	Key  string `json:"key" yaml:"key" mapstructure:"key"`
+	// CA 客户端证书ca，配置后要求设备提供证书
+	CA string `json:"ca" yaml:"ca" mapstructure:"ca"`
+}
+
+// TimerCfg sip事务定时器，单位毫秒，为0时使用RFC 3261推荐值
+type TimerCfg struct {
+	T1 int `json:"t1" yaml:"t1" mapstructure:"t1"`
+	T2 int `json:"t2" yaml:"t2" mapstructure:"t2"`
+	T4 int `json:"t4" yaml:"t4" mapstructure:"t4"`
+}
+
 type RecordCfg struct {
 	FilePath  string `json:"filepath" yaml:"filepath" mapstructure:"filepath"`
 	Expire    int    `json:"expire" yaml:"expire"  mapstructure:"expire"`
 	Recordmax int    `json:"recordmax" yaml:"recordmax"  mapstructure:"recordmax"`
 }
 
+// KeepaliveCfg 设备心跳检测配置
+type KeepaliveCfg struct {
+	// Interval 默认心跳周期，单位秒，设备未设置心跳周期时使用
+	Interval int `json:"interval" yaml:"interval" mapstructure:"interval"`
+	// Count 连续未收到心跳次数，超过后设备离线
+	Count int `json:"count" yaml:"count" mapstructure:"count"`
+}
+
+// AuthCfg 设备注册鉴权配置
+type AuthCfg struct {
+	// Algorithms 允许的摘要算法，按优先级排列，401响应中每种算法一个质询，默认MD5
+	Algorithms []string `json:"algorithms" yaml:"algorithms" mapstructure:"algorithms"`
+	// MaxFails 设备编号或来源IP在统计周期内允许的认证失败次数，超过后锁定
+	MaxFails int `json:"maxfails" yaml:"maxfails" mapstructure:"maxfails"`
+	// Lockout 失败统计周期及锁定时长，单位秒
+	Lockout int `json:"lockout" yaml:"lockout" mapstructure:"lockout"`
+	// AutoRegister 未知设备注册时记录为待审核设备，审核后可注册
+	AutoRegister bool `json:"autoregister" yaml:"autoregister" mapstructure:"autoregister"`
+}
+
+// CascadeCfg 级联上级平台配置，本平台作为下级平台注册到上级
+type CascadeCfg struct {
+	// ID 上级平台编码
+	ID string `json:"id" yaml:"id" mapstructure:"id"`
+	// Region 上级平台域
+	Region string `json:"region" yaml:"region" mapstructure:"region"`
+	// Addr 上级平台sip地址 ip:port
+	Addr string `json:"addr" yaml:"addr" mapstructure:"addr"`
+	// Transport 传输协议 udp tcp，默认udp
+	Transport string `json:"transport" yaml:"transport" mapstructure:"transport"`
+	// Username 注册用户名，默认本平台编码
+	Username string `json:"username" yaml:"username" mapstructure:"username"`
+	// Password 注册密码
+	Password string `json:"-" yaml:"password" mapstructure:"password"`
+	// Expires 注册有效期，单位秒，默认3600
+	Expires int `json:"expires" yaml:"expires" mapstructure:"expires"`
+	// Keepalive 心跳周期，单位秒，默认60
+	Keepalive int `json:"keepalive" yaml:"keepalive" mapstructure:"keepalive"`
+}
+
+// SubscribeCfg 设备订阅配置，有效期单位秒，为0时不订阅
+type SubscribeCfg struct {
+	// Catalog 目录订阅有效期
+	Catalog int `json:"catalog" yaml:"catalog" mapstructure:"catalog"`
+	// Alarm 报警订阅有效期
+	Alarm int `json:"alarm" yaml:"alarm" mapstructure:"alarm"`
+	// MobilePosition 移动设备位置订阅有效期
+	MobilePosition int `json:"mobileposition" yaml:"mobileposition" mapstructure:"mobileposition"`
+	// Interval 移动设备位置上报间隔，单位秒，默认5
+	Interval int `json:"interval" yaml:"interval" mapstructure:"interval"`
+}
+
 // Stream Stream
 type Stream struct {
 	HLS  bool `json:"hls" yaml:"hls" mapstructure:"hls"`
@@ -124,6 +199,40 @@ func LoadConfig() {
 		MConfig.Record.Expire = 7
 	}
 
+	if MConfig.Keepalive.Interval <= 0 {
+		MConfig.Keepalive.Interval = 60
+	}
+	if MConfig.Keepalive.Count <= 0 {
+		MConfig.Keepalive.Count = 3
+	}
+
+	if len(MConfig.Auth.Algorithms) == 0 {
+		MConfig.Auth.Algorithms = []string{"MD5"}
+	}
+	if MConfig.Auth.MaxFails <= 0 {
+		MConfig.Auth.MaxFails = 5
+	}
+	if MConfig.Auth.Lockout <= 0 {
+		MConfig.Auth.Lockout = 600
+	}
+
+	for i := range MConfig.Cascade {
+		cascade := &MConfig.Cascade[i]
+		if cascade.Transport == "" {
+			cascade.Transport = "udp"
+		}
+		if cascade.Expires <= 0 {
+			cascade.Expires = 3600
+		}
+		if cascade.Keepalive <= 0 {
+			cascade.Keepalive = 60
+		}
+	}
+
+	if MConfig.Subscribe.Interval <= 0 {
+		MConfig.Subscribe.Interval = 5
+	}
+
 	if MConfig.Record.Recordmax <= 0 {
 		MConfig.Record.Recordmax = 600
 	}
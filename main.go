@@ -59,8 +59,10 @@ func init() {
 }
 
 func _cron() {
-	c := cron.New()                                 // 新建一个定时任务对象
-	c.AddFunc("0 */5 * * * *", sipapi.CheckStreams) // 定时关闭推送流
-	c.AddFunc("0 */5 * * * *", sipapi.ClearFiles)   // 定时清理录制文件
+	c := cron.New()                                        // 新建一个定时任务对象
+	c.AddFunc("0 */5 * * * *", sipapi.CheckStreams)        // 定时关闭推送流
+	c.AddFunc("0 */5 * * * *", sipapi.ClearFiles)          // 定时清理录制文件
+	c.AddFunc("*/30 * * * * *", sipapi.CheckDevicesActive) // 定时检查设备心跳
+	c.AddFunc("0 * * * * *", sipapi.CleanRegisterLockouts) // 定时清理过期注册失败记录
 	c.Start()
 }
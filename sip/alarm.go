@@ -0,0 +1,144 @@
+package sipapi
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/panjjo/gosip/db"
+	sip "github.com/panjjo/gosip/sip/s"
+	"github.com/panjjo/gosip/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Alarms 设备报警
+type Alarms struct {
+	db.DBModel
+	// DeviceID 设备编号
+	DeviceID string `json:"deviceid" gorm:"column:deviceid"`
+	// ChannelID 报警通道或报警设备编号
+	ChannelID string `json:"channelid" gorm:"column:channelid"`
+	// Priority 报警级别 1一级警情 2二级警情 3三级警情 4四级警情
+	Priority string `json:"priority" gorm:"column:priority"`
+	// Method 报警方式 1电话 2设备 3短信 4GPS 5视频 6设备故障 7其他
+	Method string `json:"method" gorm:"column:method"`
+	// Type 报警类型，与报警方式对应，例如视频报警 2运动目标检测 6区域入侵
+	Type string `json:"type" gorm:"column:type"`
+	// EventType 报警事件类型 1进入区域 2离开区域
+	EventType string `json:"eventtype" gorm:"column:eventtype"`
+	// Time 报警时间
+	Time int64 `json:"time" gorm:"column:time"`
+	// Description 报警描述
+	Description string `json:"description" gorm:"column:description"`
+	// Longitude 经度
+	Longitude float64 `json:"longitude" gorm:"column:longitude"`
+	// Latitude 纬度
+	Latitude float64 `json:"latitude" gorm:"column:latitude"`
+	// Reset 是否已复位
+	Reset bool `json:"reset" gorm:"column:reset"`
+}
+
+// MessageAlarm 报警通知
+type MessageAlarm struct {
+	CmdType          string  `xml:"CmdType"`
+	SN               int     `xml:"SN"`
+	DeviceID         string  `xml:"DeviceID"`
+	AlarmPriority    string  `xml:"AlarmPriority"`
+	AlarmMethod      string  `xml:"AlarmMethod"`
+	AlarmTime        string  `xml:"AlarmTime"`
+	AlarmDescription string  `xml:"AlarmDescription"`
+	Longitude        float64 `xml:"Longitude"`
+	Latitude         float64 `xml:"Latitude"`
+	Info             struct {
+		AlarmType      string `xml:"AlarmType"`
+		AlarmTypeParam struct {
+			EventType string `xml:"EventType"`
+		} `xml:"AlarmTypeParam"`
+	} `xml:"Info"`
+}
+
+// sipMessageAlarm 报警通知，保存后向设备应答
+func sipMessageAlarm(u Devices, body []byte) error {
+	message := &MessageAlarm{}
+	if err := utils.XMLDecode(body, message); err != nil {
+		logrus.Errorln("Message Unmarshal xml err:", err, "body:", string(body))
+		return err
+	}
+	alarm := Alarms{
+		DeviceID:    u.DeviceID,
+		ChannelID:   message.DeviceID,
+		Priority:    message.AlarmPriority,
+		Method:      message.AlarmMethod,
+		Type:        message.Info.AlarmType,
+		EventType:   message.Info.AlarmTypeParam.EventType,
+		Time:        time.Now().Unix(),
+		Description: message.AlarmDescription,
+		Longitude:   message.Longitude,
+		Latitude:    message.Latitude,
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04:05", message.AlarmTime, time.Local); err == nil {
+		alarm.Time = t.Unix()
+	}
+	if err := db.Create(db.DBClient, &alarm); err != nil {
+		logrus.Errorln("save alarm fail", u.DeviceID, message.DeviceID, err)
+		return err
+	}
+	go notify(notifyAlarmsNew(alarm))
+	go sipAlarmResponse(u, message)
+	return nil
+}
+
+// sipAlarmResponse 报警通知应答
+func sipAlarmResponse(u Devices, message *MessageAlarm) {
+	device, ok := _activeDevices.Get(u.DeviceID)
+	if !ok {
+		device = u
+	}
+	if err := sipDeviceMessage(context.Background(), device, sip.GetAlarmResponseXML(message.DeviceID, message.SN)); err != nil {
+		logrus.Warnln("sipAlarmResponse fail.id:", u.DeviceID, message.DeviceID, "err:", err)
+	}
+}
+
+// SipAlarmReset 报警复位，id为报警通道或设备编号，为空时为设备编号
+func SipAlarmReset(ctx context.Context, deviceID, id, method, alarmType string) error {
+	device, ok := _activeDevices.Get(deviceID)
+	if !ok {
+		return errors.New("设备不在线")
+	}
+	if id == "" {
+		id = deviceID
+	}
+	if err := sipDeviceMessage(ctx, device, sip.GetAlarmResetXML(id, method, alarmType)); err != nil {
+		return err
+	}
+	query := db.M{"deviceid=?": deviceID, "reset=?": false}
+	if id != deviceID {
+		query["channelid=?"] = id
+	}
+	if method != "" {
+		query["method=?"] = method
+	}
+	if alarmType != "" {
+		query["type=?"] = alarmType
+	}
+	_, err := db.UpdateAll(db.DBClient, new(Alarms), query, db.M{"reset": true})
+	return err
+}
+
+// sipDeviceMessage 向设备发送MESSAGE请求
+func sipDeviceMessage(ctx context.Context, device Devices, body []byte) error {
+	if device.addr == nil {
+		return errors.New("设备地址错误")
+	}
+	hb := sip.NewHeaderBuilder().SetTo(device.addr).SetFrom(_serverDevices.addr).AddVia(&sip.ViaHop{
+		Transport: device.TransPort,
+		Params:    sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+	}).SetContentType(&sip.ContentTypeXML).SetMethod(sip.MESSAGE)
+	req := sip.NewRequest("", sip.MESSAGE, device.addr.URI, sip.DefaultSipVersion, hb.Build(), body)
+	req.SetDestination(device.source)
+	if _, err := sipRequest(ctx, req); err != nil {
+		logrus.Warnln("sipDeviceMessage fail.id:", device.DeviceID, "err:", err)
+		return err
+	}
+	return nil
+}
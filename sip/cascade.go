@@ -0,0 +1,576 @@
+package sipapi
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/panjjo/gosip/m"
+	sip "github.com/panjjo/gosip/sip/s"
+	"github.com/panjjo/gosip/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Platform 级联上级平台，本平台作为下级平台注册到上级
+type Platform struct {
+	cfg m.CascadeCfg
+	// uri 上级平台请求地址 sip:id@ip:port
+	uri *sip.URI
+	// addr 上级平台 sip:id@region
+	addr *sip.Address
+	// source 上级平台网络地址
+	source net.Addr
+	// callID 注册请求Call-ID，刷新注册时保持不变
+	callID sip.CallID
+	cseq   uint32
+
+	status PlatformStatus
+	l      sync.Mutex
+}
+
+// PlatformStatus 上级平台级联状态
+type PlatformStatus struct {
+	// ID 上级平台编码
+	ID string `json:"id"`
+	// Region 上级平台域
+	Region string `json:"region"`
+	// Addr 上级平台地址
+	Addr string `json:"addr"`
+	// Transport 传输协议
+	Transport string `json:"transport"`
+	// Online 是否注册成功
+	Online bool `json:"online"`
+	// RegisterAt 最后注册成功时间
+	RegisterAt int64 `json:"registerat"`
+	// KeepaliveAt 最后心跳成功时间
+	KeepaliveAt int64 `json:"keepaliveat"`
+	// Msg 最后一次失败原因
+	Msg string `json:"msg"`
+}
+
+// 上级平台 key=平台编码
+var _platforms *sync.Map
+
+// gbXMLHeader 国标消息xml头
+const gbXMLHeader = `<?xml version="1.0" encoding="GB2312"?>` + "\n"
+
+// catalogPageSize 目录应答每个消息的通道数，避免udp消息过大
+const catalogPageSize = 10
+
+// cascadeKeepaliveFails 连续心跳失败次数，超过后重新注册
+const cascadeKeepaliveFails = 3
+
+// StartCascade 向配置的上级平台注册
+func StartCascade() {
+	for _, cfg := range config.Cascade {
+		p, err := newPlatform(cfg)
+		if err != nil {
+			logrus.Errorln("cascade platform config error,id:", cfg.ID, "err:", err)
+			continue
+		}
+		_platforms.Store(cfg.ID, p)
+		go p.run()
+	}
+}
+
+func newPlatform(cfg m.CascadeCfg) (*Platform, error) {
+	var (
+		source net.Addr
+		err    error
+	)
+	if strings.ToUpper(cfg.Transport) == "TCP" {
+		source, err = net.ResolveTCPAddr("tcp", cfg.Addr)
+	} else {
+		source, err = net.ResolveUDPAddr("udp", cfg.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	uri, err := sip.ParseSipURI(fmt.Sprintf("sip:%s@%s", cfg.ID, cfg.Addr))
+	if err != nil {
+		return nil, err
+	}
+	addr, err := sip.ParseSipURI(fmt.Sprintf("sip:%s@%s", cfg.ID, cfg.Region))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Username == "" {
+		cfg.Username = _sysinfo.LID
+	}
+	return &Platform{
+		cfg:    cfg,
+		uri:    &uri,
+		addr:   &sip.Address{URI: &addr, Params: sip.NewParams()},
+		source: source,
+		callID: sip.CallID(utils.RandString(32)),
+		status: PlatformStatus{ID: cfg.ID, Region: cfg.Region, Addr: cfg.Addr, Transport: cfg.Transport},
+	}, nil
+}
+
+// getPlatform 获取上级平台
+func getPlatform(id string) (*Platform, bool) {
+	if v, ok := _platforms.Load(id); ok {
+		return v.(*Platform), true
+	}
+	return nil, false
+}
+
+// GetPlatforms 上级平台级联状态列表
+func GetPlatforms() []PlatformStatus {
+	list := []PlatformStatus{}
+	_platforms.Range(func(key, value any) bool {
+		p := value.(*Platform)
+		p.l.Lock()
+		list = append(list, p.status)
+		p.l.Unlock()
+		return true
+	})
+	return list
+}
+
+// match 请求是否来自上级平台地址
+func (p *Platform) match(source net.Addr) bool {
+	if source == nil {
+		return false
+	}
+	return sourceIP(source) == sourceIP(p.source)
+}
+
+func (p *Platform) setOnline(online bool, err error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	now := time.Now().Unix()
+	p.status.Online = online
+	if err != nil {
+		p.status.Msg = err.Error()
+		return
+	}
+	p.status.Msg = ""
+	if online {
+		p.status.RegisterAt = now
+		p.status.KeepaliveAt = now
+	}
+}
+
+// run 注册并保持心跳，心跳连续失败或注册即将过期时重新注册
+func (p *Platform) run() {
+	// 等待sip服务监听
+	time.Sleep(time.Second)
+	retry := time.Duration(p.cfg.Keepalive) * time.Second
+	for {
+		expires, err := p.register(p.cfg.Expires)
+		if err != nil {
+			logrus.Warnln("cascade register fail,id:", p.cfg.ID, "err:", err)
+			p.setOnline(false, err)
+			time.Sleep(retry)
+			continue
+		}
+		logrus.Infoln("cascade register succ,id:", p.cfg.ID, "expires:", expires)
+		p.setOnline(true, nil)
+		p.keepalive(time.Duration(expires) * time.Second * 4 / 5)
+	}
+}
+
+// keepalive 发送心跳直到需要刷新注册或心跳连续失败
+func (p *Platform) keepalive(refresh time.Duration) {
+	timer := time.NewTimer(refresh)
+	defer timer.Stop()
+	tick := time.NewTicker(time.Duration(p.cfg.Keepalive) * time.Second)
+	defer tick.Stop()
+	fails := 0
+	for {
+		select {
+		case <-timer.C:
+			return
+		case <-tick.C:
+			if err := p.sendMessage(context.Background(), sip.GetKeepaliveXML(_sysinfo.LID)); err != nil {
+				fails++
+				logrus.Warnln("cascade keepalive fail,id:", p.cfg.ID, "fails:", fails, "err:", err)
+				if fails >= cascadeKeepaliveFails {
+					p.setOnline(false, err)
+					return
+				}
+				continue
+			}
+			fails = 0
+			p.l.Lock()
+			p.status.KeepaliveAt = time.Now().Unix()
+			p.l.Unlock()
+		}
+	}
+}
+
+// local 本平台地址
+func (p *Platform) local() *sip.Address {
+	uri, _ := sip.ParseSipURI(fmt.Sprintf("sip:%s@%s", _sysinfo.LID, _sysinfo.Region))
+	return &sip.Address{URI: &uri, Params: sip.NewParams()}
+}
+
+// newRequest 生成发往上级平台的请求
+func (p *Platform) newRequest(method sip.RequestMethod, to *sip.Address, contentType *sip.ContentType, body []byte) (*sip.Request, error) {
+	contactURI, err := srv.LocalURI(_sysinfo.LID, p.cfg.Transport)
+	if err != nil {
+		return nil, err
+	}
+	hb := sip.NewHeaderBuilder().SetTo(to).SetFrom(p.local()).AddVia(&sip.ViaHop{
+		Transport: strings.ToUpper(p.cfg.Transport),
+		Params:    sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+	}).SetMethod(method).SetContact(&sip.Address{URI: &contactURI, Params: sip.NewParams()})
+	if method == sip.REGISTER {
+		p.l.Lock()
+		p.cseq++
+		hb.SetCallID(&p.callID).SetSeqNo(uint(p.cseq))
+		p.l.Unlock()
+	}
+	if contentType != nil {
+		hb.SetContentType(contentType)
+	}
+	req := sip.NewRequest("", method, p.uri.Clone(), sip.DefaultSipVersion, hb.Build(), body)
+	if len(body) == 0 {
+		req.SetBody([]byte{}, true)
+	}
+	req.SetDestination(p.source)
+	return req, nil
+}
+
+// register 注册到上级平台，返回上级平台允许的有效期
+func (p *Platform) register(expires int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var authorization sip.Header
+	for i := 0; i < 2; i++ {
+		req, err := p.newRequest(sip.REGISTER, p.local(), nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		e := sip.Expires(expires)
+		req.AppendHeader(&e)
+		if authorization != nil {
+			req.AppendHeader(authorization)
+		}
+		response, err := srv.RequestContext(ctx, req, nil)
+		if err != nil {
+			return 0, err
+		}
+		switch response.StatusCode() {
+		case http.StatusOK:
+			return responseExpires(response, expires), nil
+		case http.StatusUnauthorized, http.StatusProxyAuthRequired:
+			if authorization != nil {
+				return 0, errors.New("注册认证失败")
+			}
+			authorization, err = p.authorization(req, response)
+			if err != nil {
+				return 0, err
+			}
+		default:
+			return 0, utils.NewError(nil, "response fail", response.StatusCode(), response.Reason())
+		}
+	}
+	return 0, errors.New("注册认证失败")
+}
+
+// authorization 根据上级平台的质询生成认证头域，多个质询时选择第一个支持的算法
+func (p *Platform) authorization(req *sip.Request, response *sip.Response) (sip.Header, error) {
+	challenge, name := "WWW-Authenticate", "Authorization"
+	if response.StatusCode() == http.StatusProxyAuthRequired {
+		challenge, name = "Proxy-Authenticate", "Proxy-Authorization"
+	}
+	for _, hdr := range response.GetHeaders(challenge) {
+		h, ok := hdr.(*sip.GenericHeader)
+		if !ok {
+			continue
+		}
+		auth := sip.AuthFromValue(h.Contents)
+		if !sip.ValidAlgorithm(auth.Algorithm()) {
+			continue
+		}
+		auth.SetUsername(p.cfg.Username)
+		auth.SetPassword(p.cfg.Password)
+		auth.SetMethod(string(req.Method()))
+		auth.SetURI(req.Recipient().String())
+		if auth.Qop() != "" {
+			auth.SetCNonce(utils.RandString(16))
+			auth.SetNC("00000001")
+		}
+		auth.CalcResponse()
+		return &sip.GenericHeader{HeaderName: name, Contents: auth.String()}, nil
+	}
+	return nil, errors.New("不支持的认证方式")
+}
+
+// sendMessage 向上级平台发送MESSAGE
+func (p *Platform) sendMessage(ctx context.Context, body []byte) error {
+	req, err := p.newRequest(sip.MESSAGE, p.addr, &sip.ContentTypeXML, body)
+	if err != nil {
+		return err
+	}
+	_, err = sipRequest(ctx, req)
+	return err
+}
+
+// sendResponse 向上级平台发送查询应答，xml使用GB2312编码
+func (p *Platform) sendResponse(v interface{}) error {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	body, err = utils.Utf8ToGbk(append([]byte(gbXMLHeader), body...))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return p.sendMessage(ctx, body)
+}
+
+// MessageQuery 上级平台查询请求
+type MessageQuery struct {
+	CmdType   string `xml:"CmdType"`
+	SN        int    `xml:"SN"`
+	DeviceID  string `xml:"DeviceID"`
+	StartTime string `xml:"StartTime"`
+	EndTime   string `xml:"EndTime"`
+}
+
+// handlerQuery 处理上级平台查询，目录、设备信息、录像查询使用本平台通道数据应答
+func (p *Platform) handlerQuery(body []byte) {
+	query := &MessageQuery{}
+	if err := utils.XMLDecode(body, query); err != nil {
+		logrus.Errorln("cascade query unmarshal xml err:", err, "body:", string(body))
+		return
+	}
+	var err error
+	switch query.CmdType {
+	case "Catalog":
+		err = p.responseCatalog(query)
+	case "DeviceInfo":
+		err = p.responseDeviceInfo(query)
+	case "RecordInfo":
+		err = p.responseRecordInfo(query)
+	default:
+		logrus.Warnln("cascade query not support,id:", p.cfg.ID, "cmdtype:", query.CmdType)
+		return
+	}
+	if err != nil {
+		logrus.Warnln("cascade query response fail,id:", p.cfg.ID, "cmdtype:", query.CmdType, "err:", err)
+	}
+}
+
+// CascadeCatalogItem 目录应答通道
+type CascadeCatalogItem struct {
+	DeviceID     string              `xml:"DeviceID"`
+	Name         string              `xml:"Name"`
+	Manufacturer string              `xml:"Manufacturer"`
+	Model        string              `xml:"Model"`
+	Owner        string              `xml:"Owner"`
+	CivilCode    string              `xml:"CivilCode"`
+	Block        string              `xml:"Block,omitempty"`
+	Address      string              `xml:"Address"`
+	Parental     int                 `xml:"Parental"`
+	ParentID     string              `xml:"ParentID"`
+	SafetyWay    int                 `xml:"SafetyWay"`
+	RegisterWay  int                 `xml:"RegisterWay"`
+	Secrecy      int                 `xml:"Secrecy"`
+	IPAddress    string              `xml:"IPAddress,omitempty"`
+	Port         int                 `xml:"Port,omitempty"`
+	Status       string              `xml:"Status"`
+	Longitude    float64             `xml:"Longitude,omitempty"`
+	Latitude     float64             `xml:"Latitude,omitempty"`
+	Info         *CascadeCatalogInfo `xml:"Info,omitempty"`
+}
+
+// CascadeCatalogInfo 目录应答通道扩展信息
+type CascadeCatalogInfo struct {
+	PTZType             int    `xml:"PTZType,omitempty"`
+	PositionType        int    `xml:"PositionType,omitempty"`
+	RoomType            int    `xml:"RoomType,omitempty"`
+	UseType             int    `xml:"UseType,omitempty"`
+	SupplyLightType     int    `xml:"SupplyLightType,omitempty"`
+	DirectionType       int    `xml:"DirectionType,omitempty"`
+	Resolution          string `xml:"Resolution,omitempty"`
+	DownloadSpeed       string `xml:"DownloadSpeed,omitempty"`
+	SVCSpaceSupportMode int    `xml:"SVCSpaceSupportMode,omitempty"`
+	SVCTimeSupportMode  int    `xml:"SVCTimeSupportMode,omitempty"`
+}
+
+// CascadeCatalogResponse 目录应答
+type CascadeCatalogResponse struct {
+	XMLName  xml.Name `xml:"Response"`
+	CmdType  string   `xml:"CmdType"`
+	SN       int      `xml:"SN"`
+	DeviceID string   `xml:"DeviceID"`
+	SumNum   int      `xml:"SumNum"`
+	List     struct {
+		Num  int                  `xml:"Num,attr"`
+		Item []CascadeCatalogItem `xml:"Item"`
+	} `xml:"DeviceList"`
+}
+
+func newCascadeCatalogItem(share sharedChannel) CascadeCatalogItem {
+	channel := share.channel
+	status := channel.Status
+	if status != m.DeviceStatusON {
+		status = m.DeviceStatusOFF
+	}
+	registerWay := channel.RegisterWay
+	if registerWay == 0 {
+		registerWay = 1
+	}
+	item := CascadeCatalogItem{
+		DeviceID:     share.share.ShareID,
+		Name:         share.name(),
+		Manufacturer: channel.Manufacturer,
+		Model:        channel.Model,
+		Owner:        channel.Owner,
+		CivilCode:    channel.CivilCode,
+		Address:      channel.Address,
+		Parental:     channel.Parental,
+		ParentID:     _sysinfo.LID,
+		SafetyWay:    channel.SafetyWay,
+		RegisterWay:  registerWay,
+		Secrecy:      channel.Secrecy,
+		Status:       status,
+		Block:        channel.Block,
+		IPAddress:    channel.IPAddress,
+		Port:         channel.Port,
+		Longitude:    channel.Longitude,
+		Latitude:     channel.Latitude,
+	}
+	info := CascadeCatalogInfo{
+		PTZType:             channel.PTZType,
+		PositionType:        channel.PositionType,
+		RoomType:            channel.RoomType,
+		UseType:             channel.UseType,
+		SupplyLightType:     channel.SupplyLightType,
+		DirectionType:       channel.DirectionType,
+		Resolution:          channel.Resolution,
+		DownloadSpeed:       channel.DownloadSpeed,
+		SVCSpaceSupportMode: channel.SVCSpaceSupportMode,
+		SVCTimeSupportMode:  channel.SVCTimeSupportMode,
+	}
+	if info != (CascadeCatalogInfo{}) {
+		item.Info = &info
+	}
+	return item
+}
+
+// responseCatalog 目录应答，只包含共享给上级平台的通道，按页分多个消息发送
+func (p *Platform) responseCatalog(query *MessageQuery) error {
+	shares, err := p.sharedChannels()
+	if err != nil {
+		return err
+	}
+	items := []CascadeCatalogItem{}
+	for _, share := range shares {
+		items = append(items, newCascadeCatalogItem(share))
+	}
+	for i := 0; i == 0 || i < len(items); i += catalogPageSize {
+		end := i + catalogPageSize
+		if end > len(items) {
+			end = len(items)
+		}
+		res := CascadeCatalogResponse{CmdType: "Catalog", SN: query.SN, DeviceID: _sysinfo.LID, SumNum: len(items)}
+		res.List.Item = items[i:end]
+		res.List.Num = len(res.List.Item)
+		if err := p.sendResponse(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CascadeDeviceInfoResponse 设备信息应答
+type CascadeDeviceInfoResponse struct {
+	XMLName      xml.Name `xml:"Response"`
+	CmdType      string   `xml:"CmdType"`
+	SN           int      `xml:"SN"`
+	DeviceID     string   `xml:"DeviceID"`
+	DeviceName   string   `xml:"DeviceName"`
+	Result       string   `xml:"Result"`
+	Manufacturer string   `xml:"Manufacturer"`
+	Model        string   `xml:"Model"`
+	Firmware     string   `xml:"Firmware"`
+	Channel      int      `xml:"Channel"`
+}
+
+// responseDeviceInfo 设备信息应答，通道数为共享给上级平台的通道数
+func (p *Platform) responseDeviceInfo(query *MessageQuery) error {
+	shares, err := p.sharedChannels()
+	if err != nil {
+		return err
+	}
+	return p.sendResponse(CascadeDeviceInfoResponse{
+		CmdType:      "DeviceInfo",
+		SN:           query.SN,
+		DeviceID:     _sysinfo.LID,
+		DeviceName:   "gosip",
+		Result:       "OK",
+		Manufacturer: "gosip",
+		Model:        "gosip",
+		Firmware:     "gosip",
+		Channel:      len(shares),
+	})
+}
+
+// CascadeRecordInfoResponse 录像查询应答
+type CascadeRecordInfoResponse struct {
+	XMLName  xml.Name `xml:"Response"`
+	CmdType  string   `xml:"CmdType"`
+	SN       int      `xml:"SN"`
+	DeviceID string   `xml:"DeviceID"`
+	Name     string   `xml:"Name"`
+	SumNum   int      `xml:"SumNum"`
+	List     struct {
+		Num  int          `xml:"Num,attr"`
+		Item []RecordItem `xml:"Item"`
+	} `xml:"RecordList"`
+}
+
+// responseRecordInfo 录像查询应答，向共享通道所属设备查询后转发
+func (p *Platform) responseRecordInfo(query *MessageQuery) error {
+	items := []RecordItem{}
+	share, err := p.getSharedChannel(query.DeviceID)
+	channel := share.channel
+	if err == nil {
+		start, _ := time.ParseInLocation("2006-01-02T15:04:05", query.StartTime, time.Local)
+		end, _ := time.ParseInLocation("2006-01-02T15:04:05", query.EndTime, time.Local)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		records, err := SipRecordList(ctx, &channel, start.Unix(), end.Unix())
+		cancel()
+		if err != nil {
+			logrus.Warnln("cascade recordinfo fail,id:", p.cfg.ID, "channel:", channel.ChannelID, "err:", err)
+		} else {
+			for _, date := range records.Data {
+				for _, item := range date.Items {
+					items = append(items, RecordItem{
+						DeviceID:  query.DeviceID,
+						Name:      share.name(),
+						StartTime: time.Unix(item.Start, 0).Format("2006-01-02T15:04:05"),
+						EndTime:   time.Unix(item.End, 0).Format("2006-01-02T15:04:05"),
+						Type:      "time",
+					})
+				}
+			}
+		}
+	}
+	for i := 0; i == 0 || i < len(items); i += catalogPageSize {
+		end := i + catalogPageSize
+		if end > len(items) {
+			end = len(items)
+		}
+		res := CascadeRecordInfoResponse{CmdType: "RecordInfo", SN: query.SN, DeviceID: query.DeviceID, Name: share.name(), SumNum: len(items)}
+		res.List.Item = items[i:end]
+		res.List.Num = len(res.List.Item)
+		if err := p.sendResponse(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
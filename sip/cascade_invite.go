@@ -0,0 +1,305 @@
+package sipapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sdp "github.com/panjjo/gosdp"
+	"github.com/panjjo/gosip/db"
+	sip "github.com/panjjo/gosip/sip/s"
+	"github.com/panjjo/gosip/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// cascadeSession 上级平台点播会话，媒体服务器向上级转发rtp流
+type cascadeSession struct {
+	platformID string
+	channelID  string
+	streamID   string
+	ssrc       string
+	// t 0直播 1回放 2下载，回放和下载在会话结束时关闭设备流
+	t int
+}
+
+// statusCallDoesNotExist 对话不存在
+const statusCallDoesNotExist = 481
+
+// 上级平台点播会话 key=callid
+var _cascadeSessions *sync.Map
+
+// cascadeOffer 上级平台INVITE中的sdp
+type cascadeOffer struct {
+	// name Play Playback Download
+	name  string
+	ip    string
+	port  int
+	tcp   bool
+	setup string
+	ssrc  string
+	start int64
+	end   int64
+	speed int
+}
+
+// parseCascadeOffer 解析上级平台sdp，国标sdp中y、f等扩展字段按行解析
+func parseCascadeOffer(body []byte) (*cascadeOffer, error) {
+	offer := &cascadeOffer{}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		v := line[2:]
+		switch line[0] {
+		case 's':
+			offer.name = v
+		case 'c':
+			if fields := strings.Fields(v); len(fields) == 3 {
+				offer.ip = fields[2]
+			}
+		case 't':
+			if fields := strings.Fields(v); len(fields) == 2 {
+				offer.start, _ = strconv.ParseInt(fields[0], 10, 64)
+				offer.end, _ = strconv.ParseInt(fields[1], 10, 64)
+			}
+		case 'm':
+			fields := strings.Fields(v)
+			if len(fields) >= 3 && fields[0] == "video" {
+				offer.port, _ = strconv.Atoi(fields[1])
+				offer.tcp = strings.HasPrefix(strings.ToUpper(fields[2]), "TCP")
+			}
+		case 'a':
+			if strings.HasPrefix(v, "setup:") {
+				offer.setup = strings.TrimPrefix(v, "setup:")
+			} else if strings.HasPrefix(v, "downloadspeed:") {
+				offer.speed, _ = strconv.Atoi(strings.TrimPrefix(v, "downloadspeed:"))
+			}
+		case 'y':
+			offer.ssrc = v
+		}
+	}
+	if offer.ip == "" || offer.port == 0 {
+		return nil, errors.New("sdp缺少媒体地址")
+	}
+	if offer.ssrc == "" {
+		offer.ssrc = fmt.Sprintf("%010d", utils.RandInt(100000000, 999999999))
+	}
+	return offer, nil
+}
+
+// handlerInvite 上级平台点播，设备流推送到媒体服务器后由媒体服务器向上级转发
+func handlerInvite(req *sip.Request, tx *sip.Transaction) {
+	u, ok := parserDevicesFromReqeust(req)
+	if !ok {
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil))
+		return
+	}
+	platform, ok := getPlatform(u.DeviceID)
+	if !ok || !platform.match(req.Source()) {
+		logrus.Warnln("invite not from cascade platform,id:", u.DeviceID, "source:", u.Source)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusForbidden, http.StatusText(http.StatusForbidden), nil))
+		return
+	}
+	tx.Respond(sip.NewResponseFromRequest("", req, http.StatusContinue, "Trying", nil))
+	callID, ok := req.CallID()
+	if !ok || req.Recipient() == nil || req.Recipient().User() == nil {
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil))
+		return
+	}
+	shareID := req.Recipient().User().String()
+	share, err := platform.getSharedChannel(shareID)
+	if err != nil {
+		logrus.Warnln("cascade invite channel not shared,id:", platform.cfg.ID, "channel:", shareID, "err:", err)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusNotFound, http.StatusText(http.StatusNotFound), nil))
+		return
+	}
+	channelID := share.channel.ChannelID
+	offer, err := parseCascadeOffer(req.Body())
+	if err != nil {
+		logrus.Warnln("cascade invite sdp error,id:", platform.cfg.ID, "channel:", channelID, "err:", err)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusNotAcceptable, err.Error(), nil))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	session, localPort, err := cascadePlay(ctx, channelID, offer)
+	if err != nil {
+		logrus.Warnln("cascade invite fail,id:", platform.cfg.ID, "channel:", channelID, "err:", err)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusNotFound, http.StatusText(http.StatusNotFound), nil))
+		return
+	}
+	session.platformID = platform.cfg.ID
+	_cascadeSessions.Store(string(*callID), session)
+
+	res := sip.NewResponseFromRequest("", req, http.StatusOK, "OK", cascadeAnswer(offer, localPort))
+	if to, ok := res.To(); ok {
+		if to.Params == nil {
+			to.Params = sip.NewParams()
+		}
+		if !to.Params.Has("tag") {
+			to.Params.Add("tag", sip.String{Str: utils.RandString(32)})
+		}
+	}
+	if contact, err := srv.LocalURI(_sysinfo.LID, req.Transport()); err == nil {
+		res.AppendHeader(&sip.ContactHeader{Address: &contact, Params: sip.NewParams()})
+	}
+	res.AppendHeader(&sip.ContentTypeSDP)
+	tx.Respond(res)
+	logrus.Infoln("cascade invite succ,id:", platform.cfg.ID, "channel:", channelID, "stream:", session.streamID, "dst:", offer.ip, offer.port)
+}
+
+// cascadePlay 获取设备流并开始向上级平台转发，返回媒体服务器发送端口
+func cascadePlay(ctx context.Context, channelID string, offer *cascadeOffer) (*cascadeSession, int, error) {
+	data := &Streams{ChannelID: channelID, Ttag: db.M{}, Ftag: db.M{}}
+	switch offer.name {
+	case "Playback":
+		data.T = 1
+	case "Download":
+		data.T = 2
+		data.Scale = float64(offer.speed)
+		if data.Scale < 1 {
+			data.Scale = 1
+		}
+	}
+	if data.T != 0 {
+		data.S = time.Unix(offer.start, 0)
+		data.E = time.Unix(offer.end, 0)
+	}
+	var stream *Streams
+	if succ, ok := StreamList.Succ.Load(channelID); ok && data.T == 0 {
+		// 直播使用已存在的流
+		stream = succ.(*Streams)
+	} else {
+		var err error
+		if stream, err = SipPlay(ctx, data); err != nil {
+			return nil, 0, err
+		}
+	}
+	session := &cascadeSession{channelID: channelID, streamID: stream.StreamID, ssrc: offer.ssrc, t: stream.T}
+	if err := waitZLMStream(ctx, stream.StreamID); err != nil {
+		session.stop()
+		return nil, 0, err
+	}
+	values := url.Values{}
+	values.Set("stream", stream.StreamID)
+	values.Set("ssrc", offer.ssrc)
+	values.Set("pt", "96")
+	values.Set("use_ps", "1")
+	// 上级为tcp主动连接时媒体服务器被动等待连接
+	passive := offer.tcp && offer.setup == "active"
+	if !passive {
+		values.Set("dst_url", offer.ip)
+		values.Set("dst_port", strconv.Itoa(offer.port))
+		if offer.tcp {
+			values.Set("is_udp", "0")
+		} else {
+			values.Set("is_udp", "1")
+		}
+	}
+	localPort, err := zlmStartSendRtp(values, passive)
+	if err != nil {
+		session.stop()
+		return nil, 0, err
+	}
+	return session, localPort, nil
+}
+
+// waitZLMStream 等待设备流推送到媒体服务器
+func waitZLMStream(ctx context.Context, streamID string) error {
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if resp := zlmGetMediaList(zlmGetMediaListReq{streamID: streamID, app: "rtp"}); resp.Code == 0 && len(resp.Data) > 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("等待设备推流超时")
+		case <-tick.C:
+		}
+	}
+}
+
+// cascadeAnswer 应答sdp，媒体地址为媒体服务器发送端口
+func cascadeAnswer(offer *cascadeOffer, localPort int) []byte {
+	protocal := "RTP/AVP"
+	if offer.tcp {
+		protocal = "TCP/RTP/AVP"
+	}
+	video := sdp.Media{
+		Description: sdp.MediaDescription{
+			Type:     "video",
+			Port:     localPort,
+			Formats:  []string{"96"},
+			Protocol: protocal,
+		},
+	}
+	video.AddAttribute("sendonly")
+	if offer.tcp {
+		if offer.setup == "active" {
+			video.AddAttribute("setup", "passive")
+		} else {
+			video.AddAttribute("setup", "active")
+		}
+		video.AddAttribute("connection", "new")
+	}
+	video.AddAttribute("rtpmap", "96", "PS/90000")
+	msg := &sdp.Message{
+		Origin: sdp.Origin{
+			Username: _sysinfo.LID,
+			Address:  _sysinfo.MediaServerRtpIP.String(),
+		},
+		Name: offer.name,
+		Connection: sdp.ConnectionData{
+			IP:  _sysinfo.MediaServerRtpIP,
+			TTL: 0,
+		},
+		Timing: []sdp.Timing{
+			{
+				Start: time.Unix(offer.start, 0),
+				End:   time.Unix(offer.end, 0),
+			},
+		},
+		Medias: []sdp.Media{video},
+		SSRC:   offer.ssrc,
+	}
+	if offer.start == 0 {
+		msg.Timing = []sdp.Timing{{}}
+	}
+	var s sdp.Session
+	s = msg.Append(s)
+	return s.AppendTo(nil)
+}
+
+// stop 停止向上级转发，回放和下载同时关闭设备流
+func (s *cascadeSession) stop() {
+	zlmStopSendRtp(s.streamID, s.ssrc)
+	if s.t != 0 {
+		SipStopPlay(s.streamID)
+	}
+}
+
+// handlerBye 上级平台结束点播
+func handlerBye(req *sip.Request, tx *sip.Transaction) {
+	callID, ok := req.CallID()
+	if !ok {
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil))
+		return
+	}
+	v, ok := _cascadeSessions.LoadAndDelete(string(*callID))
+	if !ok {
+		tx.Respond(sip.NewResponseFromRequest("", req, statusCallDoesNotExist, "Call/Transaction Does Not Exist", nil))
+		return
+	}
+	tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", nil))
+	session := v.(*cascadeSession)
+	session.stop()
+	logrus.Infoln("cascade bye,id:", session.platformID, "channel:", session.channelID, "stream:", session.streamID)
+}
@@ -0,0 +1,79 @@
+package sipapi
+
+import (
+	"github.com/panjjo/gosip/db"
+)
+
+// PlatformChannels 上级平台共享通道，级联目录、点播、录像查询只使用共享给该平台的通道
+type PlatformChannels struct {
+	db.DBModel
+	// PlatformID 上级平台编码
+	PlatformID string `json:"platformid" gorm:"column:platformid"`
+	// ChannelID 本平台通道编码
+	ChannelID string `json:"channelid" gorm:"column:channelid"`
+	// ShareID 上级平台看到的通道编码，默认与通道编码相同
+	ShareID string `json:"shareid" gorm:"column:shareid"`
+	// Name 上级平台看到的通道名称，为空时使用通道名称
+	Name string `json:"name" gorm:"column:name"`
+}
+
+// HasPlatform 是否为配置的上级平台
+func HasPlatform(id string) bool {
+	_, ok := getPlatform(id)
+	return ok
+}
+
+// sharedChannel 共享通道及对应的本平台通道
+type sharedChannel struct {
+	share   PlatformChannels
+	channel Channels
+}
+
+// name 上级平台看到的通道名称
+func (s sharedChannel) name() string {
+	if s.share.Name != "" {
+		return s.share.Name
+	}
+	return s.channel.Name
+}
+
+// sharedChannels 共享给上级平台的通道，本平台通道已删除或标记删除的忽略
+func (p *Platform) sharedChannels() ([]sharedChannel, error) {
+	shares := []PlatformChannels{}
+	if _, err := db.FindT(db.DBClient, new(PlatformChannels), &shares, db.M{"platformid=?": p.cfg.ID}, "id", 0, -1, false); err != nil {
+		return nil, err
+	}
+	list := []sharedChannel{}
+	if len(shares) == 0 {
+		return list, nil
+	}
+	ids := make([]string, 0, len(shares))
+	for _, share := range shares {
+		ids = append(ids, share.ChannelID)
+	}
+	channels := []Channels{}
+	if _, err := db.FindT(db.DBClient, new(Channels), &channels, db.M{"channelid in (?)": ids}, "", 0, -1, false); err != nil {
+		return nil, err
+	}
+	index := map[string]Channels{}
+	for _, channel := range channels {
+		index[channel.ChannelID] = channel
+	}
+	for _, share := range shares {
+		if channel, ok := index[share.ChannelID]; ok && !channel.Removed {
+			list = append(list, sharedChannel{share: share, channel: channel})
+		}
+	}
+	return list, nil
+}
+
+// getSharedChannel 根据上级平台使用的通道编码获取共享通道
+func (p *Platform) getSharedChannel(shareID string) (sharedChannel, error) {
+	s := sharedChannel{share: PlatformChannels{PlatformID: p.cfg.ID, ShareID: shareID}}
+	if err := db.Get(db.DBClient, &s.share); err != nil {
+		return s, err
+	}
+	s.channel = Channels{ChannelID: s.share.ChannelID}
+	err := db.Get(db.DBClient, &s.channel)
+	return s, err
+}
@@ -0,0 +1,189 @@
+package sipapi
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/panjjo/gosip/db"
+	"github.com/panjjo/gosip/m"
+	"github.com/sirupsen/logrus"
+)
+
+// catalogSyncTimeout 目录组包超时，超过该时间未收到后续消息时按已收到的目录同步，不删除通道
+const catalogSyncTimeout = 10 * time.Second
+
+// catalogSync 目录查询应答组包，按设备和SN收集多个消息中的目录项
+type catalogSync struct {
+	deviceID string
+	sn       int
+	sumNum   int
+	items    map[string]Channels
+	// order 目录项接收顺序，上级分组在前时先创建分组
+	order []string
+	timer *time.Timer
+}
+
+type catalogSyncs struct {
+	syncs map[string]*catalogSync
+	l     sync.Mutex
+}
+
+// 目录组包 key=设备编码_SN
+var _catalogSyncs = &catalogSyncs{syncs: map[string]*catalogSync{}}
+
+// CatalogSyncResult 目录同步结果
+type CatalogSyncResult struct {
+	DeviceID string `json:"deviceid"`
+	SN       int    `json:"sn"`
+	// SumNum 设备应答的目录总数
+	SumNum int `json:"sumnum"`
+	// Received 实际收到的目录数
+	Received int `json:"received"`
+	// Complete 是否收齐，未收齐时不删除通道
+	Complete bool `json:"complete"`
+	// Groups 业务分组、虚拟组织数
+	Groups int `json:"groups"`
+	// Added 新增的通道
+	Added []string `json:"added"`
+	// Updated 更新的通道
+	Updated []string `json:"updated"`
+	// Removed 目录中已不存在而标记删除的通道
+	Removed []string `json:"removed"`
+	Time    int64    `json:"time"`
+}
+
+// add 收集目录项，收齐SumNum条后同步
+func (c *catalogSyncs) add(message *MessageDeviceListResponse, items []Channels) {
+	key := fmt.Sprintf("%s_%d", message.DeviceID, message.SN)
+	c.l.Lock()
+	s, ok := c.syncs[key]
+	if !ok {
+		s = &catalogSync{deviceID: message.DeviceID, sn: message.SN, sumNum: message.SumNum, items: map[string]Channels{}}
+		s.timer = time.AfterFunc(catalogSyncTimeout, func() { c.timeout(key, s) })
+		c.syncs[key] = s
+	} else {
+		s.timer.Reset(catalogSyncTimeout)
+	}
+	for _, item := range items {
+		if _, ok := s.items[item.ChannelID]; !ok {
+			s.order = append(s.order, item.ChannelID)
+		}
+		s.items[item.ChannelID] = item
+	}
+	complete := len(s.items) >= s.sumNum
+	if complete {
+		s.timer.Stop()
+		delete(c.syncs, key)
+	}
+	c.l.Unlock()
+	if complete {
+		go s.sync(true)
+	}
+}
+
+// timeout 组包超时，按已收到的目录同步
+func (c *catalogSyncs) timeout(key string, s *catalogSync) {
+	c.l.Lock()
+	if c.syncs[key] != s {
+		c.l.Unlock()
+		return
+	}
+	delete(c.syncs, key)
+	c.l.Unlock()
+	logrus.Warnln("catalog sync timeout,deviceid:", s.deviceID, "sn:", s.sn, "sumnum:", s.sumNum, "received:", len(s.items))
+	s.sync(false)
+}
+
+// sync 更新或新增通道，目录完整时标记删除目录中已不存在的通道，删除已不存在的分组
+func (s *catalogSync) sync(complete bool) {
+	result := CatalogSyncResult{
+		DeviceID: s.deviceID,
+		SN:       s.sn,
+		SumNum:   s.sumNum,
+		Received: len(s.items),
+		Complete: complete,
+		Added:    []string{},
+		Updated:  []string{},
+		Removed:  []string{},
+		Time:     time.Now().Unix(),
+	}
+	for _, id := range s.order {
+		d := s.items[id]
+		if IsGroupID(d.ChannelID) {
+			// 业务分组、虚拟组织节点
+			saveCatalogGroup(s.deviceID, d)
+			result.Groups++
+			continue
+		}
+		channel := Channels{ChannelID: d.ChannelID, DeviceID: s.deviceID}
+		err := db.Get(db.DBClient, &channel)
+		switch {
+		case err == nil:
+			updateChannelFromCatalog(&channel, d)
+			if err := db.Save(db.DBClient, &channel); err != nil {
+				logrus.Warnln("catalog sync save channel fail", s.deviceID, d.ChannelID, err)
+				continue
+			}
+			result.Updated = append(result.Updated, channel.ChannelID)
+		case db.RecordNotFound(err):
+			updateChannelFromCatalog(&channel, d)
+			channel.StreamType = m.StreamTypePush
+			if err := db.Create(db.DBClient, &channel); err != nil {
+				logrus.Warnln("catalog sync create channel fail", s.deviceID, d.ChannelID, err)
+				continue
+			}
+			result.Added = append(result.Added, channel.ChannelID)
+		default:
+			logrus.Warnln("catalog sync get channel fail", s.deviceID, d.ChannelID, err)
+			continue
+		}
+		go notify(notifyChannelsActive(channel))
+	}
+	if complete {
+		s.removeStale(&result)
+	}
+	logrus.Infoln("catalog sync,deviceid:", s.deviceID, "sn:", s.sn, "complete:", complete, "groups:", result.Groups,
+		"added:", len(result.Added), "updated:", len(result.Updated), "removed:", len(result.Removed))
+	go notify(notifyCatalogSync(result))
+}
+
+// removeStale 标记删除设备下目录中已不存在的通道，删除已不存在的分组，媒体服务器拉流的通道不在设备目录中，不处理
+func (s *catalogSync) removeStale(result *CatalogSyncResult) {
+	channels := []Channels{}
+	if _, err := db.FindT(db.DBClient, new(Channels), &channels, db.M{"deviceid=?": s.deviceID, "streamtype<>?": m.StreamTypePull, "removed=?": false}, "", 0, -1, false); err != nil {
+		logrus.Warnln("catalog sync find channels fail", s.deviceID, err)
+		return
+	}
+	for _, channel := range channels {
+		if _, ok := s.items[channel.ChannelID]; ok {
+			continue
+		}
+		if err := removeChannel(&channel); err != nil {
+			logrus.Warnln("catalog sync remove channel fail", s.deviceID, channel.ChannelID, err)
+			continue
+		}
+		result.Removed = append(result.Removed, channel.ChannelID)
+		go notify(notifyChannelsActive(channel))
+	}
+	groups := []Groups{}
+	if _, err := db.FindT(db.DBClient, new(Groups), &groups, db.M{"deviceid=?": s.deviceID}, "", 0, -1, false); err != nil {
+		logrus.Warnln("catalog sync find groups fail", s.deviceID, err)
+		return
+	}
+	for _, group := range groups {
+		if _, ok := s.items[group.GroupID]; !ok {
+			deleteCatalogGroup(s.deviceID, group.GroupID)
+		}
+	}
+}
+
+// removeChannel 标记删除设备目录中已不存在的通道，保留上级平台共享等配置，设备重新上报后恢复
+func removeChannel(channel *Channels) error {
+	if _, err := db.UpdateAll(db.DBClient, new(Channels), db.M{"channelid=?": channel.ChannelID, "deviceid=?": channel.DeviceID}, db.M{"removed": true, "status": m.DeviceStatusOFF}); err != nil {
+		return err
+	}
+	channel.Removed = true
+	channel.Status = m.DeviceStatusOFF
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/panjjo/gosip/db"
@@ -51,10 +52,24 @@ type Devices struct {
 	URIStr string `json:"uri"  gorm:"column:uri"`
 	// ActiveAt 最后心跳检测时间
 	ActiveAt int64 `json:"active" gorm:"column:active"`
+	// KeepaliveInterval 心跳周期，单位秒，为0时使用配置
+	KeepaliveInterval int `json:"keepaliveinterval" gorm:"column:keepaliveinterval"`
 	// Regist 是否注册
 	Regist bool `json:"regist"  gorm:"column:regist"`
+	// Pending 自动注册待审核，审核通过设置密码后才能注册
+	Pending bool `json:"pending" gorm:"column:pending"`
+	// Expires 注册有效期，单位秒
+	Expires int `json:"expires" gorm:"column:expires"`
+	// ExpiresAt 注册过期时间，未刷新注册时自动离线
+	ExpiresAt int64 `json:"expiresat" gorm:"column:expiresat"`
+	// Algorithm 最近一次注册使用的摘要算法
+	Algorithm string `json:"algorithm" gorm:"column:algorithm"`
+	// AuthAlgorithms 设备允许的摘要算法，多个使用逗号分隔，按优先级排列，为空时使用配置
+	AuthAlgorithms string `json:"authalgorithms" gorm:"column:authalgorithms"`
 	// PWD 密码
 	PWD string `json:"pwd" gorm:"column:pwd"`
+	// AllowCIDRs 允许注册的来源网段，多个使用逗号分隔，为空不限制
+	AllowCIDRs string `json:"allowcidrs" gorm:"column:allowcidrs"`
 	// Source
 	Source string `json:"source"  gorm:"column:source"`
 
@@ -80,17 +95,39 @@ type Channels struct {
 	Model        string `xml:"Model" json:"model"  gorm:"column:model"`
 	Owner        string `xml:"Owner"  json:"owner"  gorm:"column:owner"`
 	CivilCode    string `xml:"CivilCode" json:"civilcode"  gorm:"column:civilcode"`
-	// Address ip地址
+	// Block 警区
+	Block string `xml:"Block" json:"block" gorm:"column:block"`
+	// Address 安装地址
 	Address     string `xml:"Address"  json:"address"  gorm:"column:address"`
 	Parental    int    `xml:"Parental"  json:"parental"  gorm:"column:parental"`
 	SafetyWay   int    `xml:"SafetyWay"  json:"safetyway"  gorm:"column:safetyway"`
 	RegisterWay int    `xml:"RegisterWay"  json:"registerway"  gorm:"column:registerway"`
-	Secrecy     int    `xml:"Secrecy" json:"secrecy"  gorm:"column:secrecy"`
+	// CertNum 证书序列号
+	CertNum string `xml:"CertNum" json:"certnum" gorm:"column:certnum"`
+	// Certifiable 证书有效标识 0无效 1有效
+	Certifiable int `xml:"Certifiable" json:"certifiable" gorm:"column:certifiable"`
+	// ErrCode 证书无效原因码
+	ErrCode int `xml:"ErrCode" json:"errcode" gorm:"column:errcode"`
+	// EndTime 证书终止有效期
+	EndTime string `xml:"EndTime" json:"endtime" gorm:"column:endtime"`
+	Secrecy int    `xml:"Secrecy" json:"secrecy"  gorm:"column:secrecy"`
+	// IPAddress 设备ip地址
+	IPAddress string `xml:"IPAddress" json:"ipaddress" gorm:"column:ipaddress"`
+	// Port 设备端口
+	Port int `xml:"Port" json:"port" gorm:"column:port"`
+	// ParentID 目录中的上级编码，可能为设备、业务分组或虚拟组织
+	ParentID string `xml:"ParentID" json:"parentid" gorm:"column:parentid"`
+	// BusinessGroupID 目录中的业务分组编码
+	BusinessGroupID string `xml:"BusinessGroupID" json:"businessgroupid" gorm:"column:businessgroupid"`
+	// GroupID 目录树中所属分组，目录同步时根据ParentID自动设置
+	GroupID string `xml:"-" json:"groupid" gorm:"column:groupid"`
 	// Status 状态  on 在线
 	Status string `xml:"Status"  json:"status"  gorm:"column:status"`
 	// Active 最后活跃时间
 	Active int64  `json:"active"  gorm:"column:active"`
 	URIStr string ` json:"uri"  gorm:"column:uri"`
+	// Removed 设备目录中已不存在，保留通道及共享配置，设备重新上报后恢复
+	Removed bool `xml:"-" json:"removed" gorm:"column:removed"`
 
 	// 视频编码格式
 	VF string ` json:"vf"  gorm:"column:vf"`
@@ -104,6 +141,44 @@ type Channels struct {
 	StreamType string `json:"streamtype"  gorm:"column:streamtype"`
 	// streamtype=pull时，拉流地址
 	URL string `json:"url"  gorm:"column:url"`
+	// Longitude 经度
+	Longitude float64 `xml:"Longitude" json:"longitude" gorm:"column:longitude"`
+	// Latitude 纬度
+	Latitude float64 `xml:"Latitude" json:"latitude" gorm:"column:latitude"`
+	// Speed 最新上报速度(km/h)
+	Speed float64 `xml:"-" json:"speed" gorm:"column:speed"`
+	// Direction 最新上报方向，正北方向顺时针夹角
+	Direction float64 `xml:"-" json:"direction" gorm:"column:direction"`
+	// Altitude 最新上报海拔高度(m)
+	Altitude float64 `xml:"-" json:"altitude" gorm:"column:altitude"`
+	// PositionAt 最新位置上报时间
+	PositionAt int64 `xml:"-" json:"positionat" gorm:"column:positionat"`
+	// PTZType 摄像机类型 1球机 2半球 3固定枪机 4遥控枪机
+	PTZType int `xml:"Info>PTZType" json:"ptztype" gorm:"column:ptztype"`
+	// PositionType 摄像机位置类型 1省际检查站 2党政机关 3车站码头 4中心广场 5体育场馆 6商业中心 7宗教场所 8校园周边 9治安复杂区域 10交通干线
+	PositionType int `xml:"Info>PositionType" json:"positiontype" gorm:"column:positiontype"`
+	// RoomType 安装位置室外、室内属性 1室外 2室内
+	RoomType int `xml:"Info>RoomType" json:"roomtype" gorm:"column:roomtype"`
+	// UseType 用途属性 1治安 2交通 3重点
+	UseType int `xml:"Info>UseType" json:"usetype" gorm:"column:usetype"`
+	// SupplyLightType 补光属性 1无补光 2红外补光 3白光补光
+	SupplyLightType int `xml:"Info>SupplyLightType" json:"supplylighttype" gorm:"column:supplylighttype"`
+	// DirectionType 监视方位属性 1东 2西 3南 4北 5东南 6东北 7西南 8西北
+	DirectionType int `xml:"Info>DirectionType" json:"directiontype" gorm:"column:directiontype"`
+	// Resolution 支持的分辨率，多个使用/分隔
+	Resolution string `xml:"Info>Resolution" json:"resolution" gorm:"column:resolution"`
+	// DownloadSpeed 支持的下载倍速，多个使用/分隔
+	DownloadSpeed string `xml:"Info>DownloadSpeed" json:"downloadspeed" gorm:"column:downloadspeed"`
+	// SVCSpaceSupportMode 空域编码能力 0不支持 1一级增强 2二级增强 3三级增强
+	SVCSpaceSupportMode int `xml:"Info>SVCSpaceSupportMode" json:"svcspacesupportmode" gorm:"column:svcspacesupportmode"`
+	// SVCTimeSupportMode 时域编码能力 0不支持 1一级增强 2二级增强 3三级增强
+	SVCTimeSupportMode int `xml:"Info>SVCTimeSupportMode" json:"svctimesupportmode" gorm:"column:svctimesupportmode"`
+	// SSVCRatioSupportList 支持的SSVC增强层与基本层比例，多个使用/分隔，GB28181-2022
+	SSVCRatioSupportList string `xml:"Info>SSVCRatioSupportList" json:"ssvcratiosupportlist" gorm:"column:ssvcratiosupportlist"`
+	// StreamNumberList 支持的码流编号列表，多个使用/分隔，GB28181-2022
+	StreamNumberList string `xml:"Info>StreamNumberList" json:"streamnumberlist" gorm:"column:streamnumberlist"`
+	// Event 目录订阅通知事件 ADD,DEL,UPDATE,ON,OFF,VLOST,DEFECT
+	Event string `xml:"Event" json:"-" gorm:"-"`
 
 	addr *sip.Address `gorm:"-"`
 }
@@ -187,7 +262,8 @@ func parserDevicesFromReqeust(req *sip.Request) (Devices, bool) {
 // 获取设备信息（注册设备）
 func sipDeviceInfo(to Devices) {
 	hb := sip.NewHeaderBuilder().SetTo(to.addr).SetFrom(_serverDevices.addr).AddVia(&sip.ViaHop{
-		Params: sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+		Transport: to.TransPort,
+		Params:    sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
 	}).SetContentType(&sip.ContentTypeXML).SetMethod(sip.MESSAGE)
 	req := sip.NewRequest("", sip.MESSAGE, to.addr.URI, sip.DefaultSipVersion, hb.Build(), sip.GetDeviceInfoXML(to.DeviceID))
 	req.SetDestination(to.source)
@@ -206,7 +282,8 @@ func sipDeviceInfo(to Devices) {
 // sipCatalog 获取注册设备包含的列表
 func sipCatalog(to Devices) {
 	hb := sip.NewHeaderBuilder().SetTo(to.addr).SetFrom(_serverDevices.addr).AddVia(&sip.ViaHop{
-		Params: sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+		Transport: to.TransPort,
+		Params:    sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
 	}).SetContentType(&sip.ContentTypeXML).SetMethod(sip.MESSAGE)
 	req := sip.NewRequest("", sip.MESSAGE, to.addr.URI, sip.DefaultSipVersion, hb.Build(), sip.GetCatalogXML(to.DeviceID))
 	req.SetDestination(to.source)
@@ -265,33 +342,126 @@ func sipMessageCatalog(u Devices, body []byte) error {
 		return err
 	}
 	if message.SumNum > 0 {
+		items := []Channels{}
 		for _, d := range message.Item {
-			channel := Channels{ChannelID: d.ChannelID, DeviceID: message.DeviceID}
-			if err := db.Get(db.DBClient, &channel); err == nil {
-				channel.Active = time.Now().Unix()
-				channel.URIStr = fmt.Sprintf("sip:%s@%s", d.ChannelID, _sysinfo.Region)
-				channel.Status = transDeviceStatus(d.Status)
-				channel.Name = d.Name
-				channel.Manufacturer = d.Manufacturer
-				channel.Model = d.Model
-				channel.Owner = d.Owner
-				channel.CivilCode = d.CivilCode
-				// Address ip地址
-				channel.Address = d.Address
-				channel.Parental = d.Parental
-				channel.SafetyWay = d.SafetyWay
-				channel.RegisterWay = d.RegisterWay
-				channel.Secrecy = d.Secrecy
-				db.Save(db.DBClient, &channel)
-				go notify(notifyChannelsActive(channel))
-			} else {
-				logrus.Infoln("deviceid not found,deviceid:", d.DeviceID, "pdid:", message.DeviceID, "err", err)
+			if d.Event != "" {
+				// 目录订阅通知，增量更新
+				sipCatalogEvent(message.DeviceID, d)
+				continue
 			}
+			items = append(items, d)
+		}
+		if len(items) > 0 {
+			// 查询应答分多个消息发送，收齐后统一同步
+			_catalogSyncs.add(message, items)
 		}
 	}
 	return nil
 }
 
+// updateChannelFromCatalog 使用目录信息更新通道
+func updateChannelFromCatalog(channel *Channels, d Channels) {
+	channel.Active = time.Now().Unix()
+	channel.Removed = false
+	channel.URIStr = fmt.Sprintf("sip:%s@%s", d.ChannelID, _sysinfo.Region)
+	channel.Status = transDeviceStatus(d.Status)
+	channel.Name = d.Name
+	channel.Manufacturer = d.Manufacturer
+	channel.Model = d.Model
+	channel.Owner = d.Owner
+	channel.CivilCode = d.CivilCode
+	channel.Block = d.Block
+	channel.Address = d.Address
+	channel.Parental = d.Parental
+	channel.SafetyWay = d.SafetyWay
+	channel.RegisterWay = d.RegisterWay
+	channel.CertNum = d.CertNum
+	channel.Certifiable = d.Certifiable
+	channel.ErrCode = d.ErrCode
+	channel.EndTime = d.EndTime
+	channel.Secrecy = d.Secrecy
+	channel.IPAddress = d.IPAddress
+	channel.Port = d.Port
+	// 目录中无坐标时保留移动位置上报的坐标
+	if d.Longitude != 0 || d.Latitude != 0 {
+		channel.Longitude = d.Longitude
+		channel.Latitude = d.Latitude
+	}
+	channel.PTZType = d.PTZType
+	channel.PositionType = d.PositionType
+	channel.RoomType = d.RoomType
+	channel.UseType = d.UseType
+	channel.SupplyLightType = d.SupplyLightType
+	channel.DirectionType = d.DirectionType
+	channel.Resolution = d.Resolution
+	channel.DownloadSpeed = d.DownloadSpeed
+	channel.SVCSpaceSupportMode = d.SVCSpaceSupportMode
+	channel.SVCTimeSupportMode = d.SVCTimeSupportMode
+	channel.SSVCRatioSupportList = d.SSVCRatioSupportList
+	channel.StreamNumberList = d.StreamNumberList
+	channel.ParentID = d.ParentID
+	channel.BusinessGroupID = d.BusinessGroupID
+	if groupID := catalogGroupID(d); groupID != "" {
+		channel.GroupID = groupID
+	}
+}
+
+// sipCatalogEvent 目录订阅通知事件处理
+func sipCatalogEvent(deviceID string, d Channels) {
+	if IsGroupID(d.ChannelID) {
+		switch strings.ToUpper(d.Event) {
+		case "ADD", "UPDATE":
+			saveCatalogGroup(deviceID, d)
+		case "DEL":
+			deleteCatalogGroup(deviceID, d.ChannelID)
+		}
+		return
+	}
+	channel := Channels{ChannelID: d.ChannelID, DeviceID: deviceID}
+	err := db.Get(db.DBClient, &channel)
+	if err != nil && !db.RecordNotFound(err) {
+		logrus.Warnln("catalog event get channel fail", deviceID, d.ChannelID, err)
+		return
+	}
+	exist := err == nil
+	switch strings.ToUpper(d.Event) {
+	case "ADD", "UPDATE":
+		updateChannelFromCatalog(&channel, d)
+		if exist {
+			db.Save(db.DBClient, &channel)
+		} else {
+			channel.StreamType = m.StreamTypePush
+			db.Create(db.DBClient, &channel)
+			logrus.Infoln("catalog event add channel", deviceID, d.ChannelID)
+		}
+	case "DEL":
+		if !exist {
+			return
+		}
+		if err := removeChannel(&channel); err != nil {
+			logrus.Warnln("catalog event remove channel fail", deviceID, d.ChannelID, err)
+			return
+		}
+		logrus.Infoln("catalog event remove channel", deviceID, d.ChannelID)
+	case "ON", "OFF", "VLOST", "DEFECT":
+		// VLOST 视频丢失，DEFECT 故障，通道不可用
+		status := m.DeviceStatusOFF
+		if strings.ToUpper(d.Event) == "ON" {
+			status = m.DeviceStatusON
+		}
+		if !exist {
+			return
+		}
+		channel.Status = status
+		channel.Active = time.Now().Unix()
+		db.Save(db.DBClient, &channel)
+	default:
+		logrus.Warnln("catalog event not support", deviceID, d.ChannelID, d.Event)
+		return
+	}
+	go notify(notifyChannelsActive(channel))
+}
+
 var deviceStatusMap = map[string]string{
 	"ON":     m.DeviceStatusON,
 	"OK":     m.DeviceStatusON,
@@ -0,0 +1,174 @@
+package sipapi
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/panjjo/gosip/db"
+	"github.com/panjjo/gosip/m"
+	"github.com/panjjo/gosip/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// MediaStatus 通知类型
+const (
+	// MediaStatusFileEnd 历史媒体文件发送结束
+	MediaStatusFileEnd = "121"
+)
+
+// MessageMediaStatus 媒体通知
+type MessageMediaStatus struct {
+	CmdType    string `xml:"CmdType"`
+	SN         int    `xml:"SN"`
+	DeviceID   string `xml:"DeviceID"`
+	NotifyType string `xml:"NotifyType"`
+}
+
+// DownloadProgress 下载进度
+type DownloadProgress struct {
+	StreamID string `json:"streamid"`
+	// Progress 下载进度 0-1
+	Progress float64 `json:"progress"`
+	// Finished 是否下载完成
+	Finished bool `json:"finished"`
+	// FileID 录制文件id，对应Files.FID
+	FileID string `json:"fileid"`
+}
+
+// Progress 下载进度，未收到发送结束通知前按下载倍速估算，最大0.99，调用方需持有流锁
+func (s *Streams) Progress() float64 {
+	if s.Finished {
+		return 1
+	}
+	total := s.E.Unix() - s.S.Unix()
+	if total <= 0 {
+		return 0
+	}
+	progress := float64(s.CurrentPosition()) / float64(total)
+	if progress > 0.99 {
+		progress = 0.99
+	}
+	return progress
+}
+
+// GetDownloadProgress 获取下载进度
+func GetDownloadProgress(streamID string) (*DownloadProgress, bool) {
+	if data, ok := StreamList.Response.Load(streamID); ok {
+		stream := data.(*Streams)
+		if stream.T != 2 {
+			return nil, false
+		}
+		stream.l.Lock()
+		defer stream.l.Unlock()
+		return &DownloadProgress{StreamID: stream.StreamID, Progress: stream.Progress(), Finished: stream.Finished, FileID: stream.FileID}, true
+	}
+	// 已结束的下载从数据库查询
+	stream := Streams{StreamID: streamID}
+	if err := db.Get(db.DBClient, &stream); err != nil || stream.T != 2 {
+		return nil, false
+	}
+	progress := &DownloadProgress{StreamID: stream.StreamID, Finished: stream.Finished, FileID: stream.FileID}
+	if stream.Finished {
+		progress.Progress = 1
+	}
+	return progress, true
+}
+
+// StartDownloadRecord 下载流推流成功后开始录制文件
+func StartDownloadRecord(stream *Streams) {
+	if stream.T != 2 || stream.FileID != "" {
+		return
+	}
+	if _, ok := RecordList.Get(stream.StreamID); ok {
+		return
+	}
+	values := url.Values{}
+	values.Set("secret", config.Media.Secret)
+	values.Set("type", "1")
+	values.Set("vhost", "__defaultVhost__")
+	values.Set("app", "rtp")
+	values.Set("stream", stream.StreamID)
+	item := RecordList.Start(stream.StreamID, values)
+	code, data := item.Start()
+	if code != m.StatusSucc {
+		RecordList.Stop(stream.StreamID)
+		logrus.Warnln("download record start fail.", stream.StreamID, data)
+		return
+	}
+	stream.FileID = item.id
+	db.Save(db.DBClient, stream)
+}
+
+// sipMessageMediaStatus 媒体通知，优先使用Call-ID匹配流，其次使用通道匹配唯一进行中的回放或下载
+func sipMessageMediaStatus(u Devices, callID string, body []byte) error {
+	message := &MessageMediaStatus{}
+	if err := utils.XMLDecode(body, message); err != nil {
+		logrus.Errorln("Message Unmarshal xml err:", err, "body:", string(body))
+		return err
+	}
+	if message.NotifyType != MediaStatusFileEnd {
+		return nil
+	}
+	var stream *Streams
+	// 通道匹配的进行中回放或下载，同一通道存在多个时无法确定结束的流
+	channelStreams := []*Streams{}
+	StreamList.Response.Range(func(key, value any) bool {
+		item := value.(*Streams)
+		if item.T == 0 || item.isFinished() {
+			return true
+		}
+		if item.CallID == callID {
+			stream = item
+			return false
+		}
+		if item.ChannelID == message.DeviceID {
+			channelStreams = append(channelStreams, item)
+		}
+		return true
+	})
+	if stream == nil && len(channelStreams) > 1 {
+		logrus.Warnln("media status stream ambiguous, ignored", u.DeviceID, message.DeviceID, callID, "streams:", len(channelStreams))
+		return nil
+	}
+	if stream == nil && len(channelStreams) == 1 {
+		stream = channelStreams[0]
+	}
+	if stream == nil {
+		logrus.Infoln("media status stream not found", u.DeviceID, message.DeviceID, callID)
+		return errors.New("media status stream not found")
+	}
+	go streamEnd(stream)
+	return nil
+}
+
+// isFinished 媒体文件是否发送完成
+func (s *Streams) isFinished() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.Finished
+}
+
+// streamEnd 历史媒体文件发送结束，下载的停止录制，发送BYE关闭流，重复通知忽略
+func streamEnd(stream *Streams) {
+	stream.l.Lock()
+	if stream.Finished {
+		stream.l.Unlock()
+		return
+	}
+	stream.Finished = true
+	stream.l.Unlock()
+	logrus.Infoln("stream end", stream.StreamID, stream.ChannelID, stream.T)
+	db.UpdateAll(db.DBClient, new(Streams), db.M{"streamid=?": stream.StreamID}, db.M{"finished": true})
+	if item, ok := RecordList.Get(stream.StreamID); ok && stream.T == 2 {
+		// 录制文件完成后由on_record_mp4回调更新文件地址
+		if code, data := item.Stop(); code != m.StatusSucc {
+			logrus.Warnln("download record stop fail.", stream.StreamID, data)
+		}
+		select {
+		case item.clos <- true:
+		default:
+		}
+	}
+	SipStopPlay(stream.StreamID)
+	notify(notifyStreamsEnd(stream))
+}
@@ -74,7 +74,7 @@ func (ri *apiRecordItem) Start() (string, interface{}) {
 		}
 	}()
 
-	err = db.Create(db.DBClient, Files{
+	err = db.Create(db.DBClient, &Files{
 		FID:    ri.id,
 		Stream: ri.params.Get("stream"),
 		params: ri.params,
@@ -93,8 +93,9 @@ func (ri *apiRecordItem) Stop() (string, interface{}) {
 	return m.StatusSucc, ""
 }
 
+// Down 录制完成，保存文件地址，FID字段对应数据库列f_id
 func (ri *apiRecordItem) Down(url string) {
-	db.UpdateAll(db.DBClient, new(Files), db.M{"id=?": ri.id}, db.M{"end": time.Now().Unix(), "status": 1, "file": url})
+	db.UpdateAll(db.DBClient, new(Files), db.M{"f_id=?": ri.id}, db.M{"end": time.Now().Unix(), "status": 1, "file": url})
 }
 
 func (ri *apiRecordItem) Resp(data string) {
@@ -129,7 +130,7 @@ func ClearFiles() {
 			ids = append(ids, file.FID)
 		}
 		if len(ids) > 0 {
-			db.UpdateAll(db.DBClient, new(Files), db.M{"id in (?)": ids}, db.M{"clear": true})
+			db.UpdateAll(db.DBClient, new(Files), db.M{"f_id in (?)": ids}, db.M{"clear": true})
 		}
 		if len(files) != 100 {
 			break
@@ -0,0 +1,290 @@
+package sipapi
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/panjjo/gorm"
+	"github.com/panjjo/gosip/db"
+	"github.com/sirupsen/logrus"
+)
+
+// 国标编码类型码，编码第11~13位
+const (
+	// GroupTypeBusiness 业务分组
+	GroupTypeBusiness = 215
+	// GroupTypeVirtual 虚拟组织
+	GroupTypeVirtual = 216
+)
+
+// Groups 业务分组、虚拟组织，组成通道目录树
+type Groups struct {
+	db.DBModel
+	// GroupID 分组编码，20位国标编码，类型码215业务分组，216虚拟组织
+	GroupID string `json:"groupid" gorm:"column:groupid"`
+	// Name 分组名称
+	Name string `json:"name" gorm:"column:name"`
+	// Type 215业务分组 216虚拟组织
+	Type int `json:"type" gorm:"column:type"`
+	// ParentID 上级分组编码，为空时为根节点
+	ParentID string `json:"parentid" gorm:"column:parentid"`
+	// BusinessGroupID 虚拟组织所属业务分组
+	BusinessGroupID string `json:"businessgroupid" gorm:"column:businessgroupid"`
+	// DeviceID 目录同步时的来源设备，手动创建为空
+	DeviceID string `json:"deviceid" gorm:"column:deviceid"`
+}
+
+// GroupType 获取编码类型码，非20位编码返回0
+func GroupType(id string) int {
+	if !ValidDeviceID(id) {
+		return 0
+	}
+	t, _ := strconv.Atoi(id[10:13])
+	return t
+}
+
+// IsGroupID 是否为业务分组或虚拟组织编码
+func IsGroupID(id string) bool {
+	t := GroupType(id)
+	return t == GroupTypeBusiness || t == GroupTypeVirtual
+}
+
+// catalogParentID 目录中的ParentID可能为多级路径，取最后一级
+func catalogParentID(parentID string) string {
+	parentID = strings.Trim(parentID, "/")
+	if i := strings.LastIndex(parentID, "/"); i >= 0 {
+		return parentID[i+1:]
+	}
+	return parentID
+}
+
+// catalogGroupID 目录中通道所属的分组，ParentID不是分组时使用业务分组
+func catalogGroupID(d Channels) string {
+	if parentID := catalogParentID(d.ParentID); IsGroupID(parentID) {
+		return parentID
+	}
+	if IsGroupID(d.BusinessGroupID) {
+		return d.BusinessGroupID
+	}
+	return ""
+}
+
+// saveCatalogGroup 保存目录中的业务分组、虚拟组织节点
+func saveCatalogGroup(deviceID string, d Channels) {
+	group := Groups{GroupID: d.ChannelID}
+	err := db.Get(db.DBClient, &group)
+	if err != nil && !db.RecordNotFound(err) {
+		logrus.Warnln("catalog get group fail", deviceID, d.ChannelID, err)
+		return
+	}
+	exist := err == nil
+	group.Name = d.Name
+	group.Type = GroupType(d.ChannelID)
+	group.DeviceID = deviceID
+	group.ParentID = ""
+	if group.Type == GroupTypeVirtual {
+		group.BusinessGroupID = d.BusinessGroupID
+		// 虚拟组织上级为虚拟组织或业务分组，业务分组为根节点
+		if parentID := catalogParentID(d.ParentID); IsGroupID(parentID) && parentID != d.ChannelID {
+			group.ParentID = parentID
+		} else if IsGroupID(d.BusinessGroupID) {
+			group.ParentID = d.BusinessGroupID
+		}
+		if group.ParentID != "" && groupDescendant(group.ParentID, group.GroupID) {
+			// 上级为自身的下级分组时成环，作为根节点
+			logrus.Warnln("catalog group parent cycle", deviceID, d.ChannelID, group.ParentID)
+			group.ParentID = ""
+		}
+	}
+	if exist {
+		db.Save(db.DBClient, &group)
+		return
+	}
+	if err := db.Create(db.DBClient, &group); err != nil {
+		logrus.Warnln("catalog create group fail", deviceID, d.ChannelID, err)
+		return
+	}
+	logrus.Infoln("catalog add group", deviceID, d.ChannelID, d.Name)
+}
+
+// groupDescendant 分组是否为指定分组自身或其下级分组
+func groupDescendant(groupID, ancestorID string) bool {
+	visited := map[string]bool{}
+	for id := groupID; id != "" && !visited[id]; {
+		visited[id] = true
+		if id == ancestorID {
+			return true
+		}
+		group := Groups{GroupID: id}
+		if err := db.Get(db.DBClient, &group); err != nil {
+			return false
+		}
+		id = group.ParentID
+	}
+	return false
+}
+
+// deleteCatalogGroup 目录通知删除分组，分组下通道移出
+func deleteCatalogGroup(deviceID string, groupID string) {
+	if err := DeleteGroup(groupID); err != nil {
+		logrus.Warnln("catalog delete group fail", deviceID, groupID, err)
+		return
+	}
+	logrus.Infoln("catalog delete group", deviceID, groupID)
+}
+
+// DeleteGroup 删除分组，下级分组上移到被删除分组的上级，分组下通道移出
+func DeleteGroup(groupID string) error {
+	group := Groups{GroupID: groupID}
+	if err := db.Get(db.DBClient, &group); err != nil {
+		return err
+	}
+	tx, err := db.NewTx(db.DBClient)
+	if err != nil {
+		return err
+	}
+	defer tx.End()
+	if _, err := db.UpdateAll(tx.DB(), new(Groups), db.M{"parentid=?": groupID}, db.M{"parentid": group.ParentID}); err != nil {
+		return err
+	}
+	if _, err := db.UpdateAll(tx.DB(), new(Channels), db.M{"groupid=?": groupID}, db.M{"groupid": ""}); err != nil {
+		return err
+	}
+	if err := db.Del(tx.DB(), &group); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TreeNode 目录树节点
+type TreeNode struct {
+	// ID 分组编码或通道编码
+	ID string `json:"id"`
+	// Name 名称
+	Name string `json:"name"`
+	// Type 215业务分组 216虚拟组织 通道为通道编码类型码
+	Type int `json:"type"`
+	// ParentID 上级分组编码
+	ParentID string `json:"parentid"`
+	// Channel 是否为通道
+	Channel bool `json:"channel"`
+	// Status 通道状态
+	Status string `json:"status,omitempty"`
+	// Channels 分组下直属通道数
+	Channels int `json:"channels"`
+	// Leaf 是否无下级节点，懒加载时判断是否可展开
+	Leaf bool `json:"leaf"`
+	// Children 下级分组，完整树时返回
+	Children []*TreeNode `json:"children,omitempty"`
+}
+
+// groupNodes 加载全部分组节点，上级分组不存在的作为根节点
+func groupNodes() (map[string]*TreeNode, []*TreeNode, error) {
+	groups := []Groups{}
+	if _, err := db.FindT(db.DBClient, new(Groups), &groups, db.M{}, "name", 0, -1, false); err != nil {
+		return nil, nil, err
+	}
+	ids := []string{}
+	if err := db.DBClient.Model(new(Channels)).Where("groupid <> '' AND removed = ?", false).Pluck("groupid", &ids).Error; err != nil {
+		return nil, nil, err
+	}
+	nodes := map[string]*TreeNode{}
+	for _, group := range groups {
+		nodes[group.GroupID] = &TreeNode{ID: group.GroupID, Name: group.Name, Type: group.Type, ParentID: group.ParentID, Leaf: true}
+	}
+	for _, id := range ids {
+		if node, ok := nodes[id]; ok {
+			node.Channels++
+			node.Leaf = false
+		}
+	}
+	// 上级关系成环时环上的分组均作为根节点，先全部判断再调整上级
+	cycles := map[string]bool{}
+	for _, group := range groups {
+		if inGroupCycle(nodes, group.GroupID) {
+			cycles[group.GroupID] = true
+		}
+	}
+	roots := []*TreeNode{}
+	for _, group := range groups {
+		node := nodes[group.GroupID]
+		if cycles[group.GroupID] {
+			logrus.Warnln("group parent cycle", group.GroupID, group.ParentID)
+		} else if parent, ok := nodes[group.ParentID]; ok {
+			parent.Children = append(parent.Children, node)
+			parent.Leaf = false
+			continue
+		}
+		node.ParentID = ""
+		roots = append(roots, node)
+	}
+	return nodes, roots, nil
+}
+
+// inGroupCycle 沿上级分组向上查找是否回到自身，自身为上级时也视为成环
+func inGroupCycle(nodes map[string]*TreeNode, groupID string) bool {
+	visited := map[string]bool{}
+	for id := nodes[groupID].ParentID; !visited[id]; {
+		visited[id] = true
+		if id == groupID {
+			return true
+		}
+		node, ok := nodes[id]
+		if !ok {
+			return false
+		}
+		id = node.ParentID
+	}
+	return false
+}
+
+// GetTree 完整分组树，不包含通道
+func GetTree() ([]*TreeNode, error) {
+	_, roots, err := groupNodes()
+	return roots, err
+}
+
+// GetTreeChildren 懒加载，返回分组的直属下级分组和通道，parentID为空时返回根节点
+func GetTreeChildren(parentID string) ([]*TreeNode, error) {
+	nodes, roots, err := groupNodes()
+	if err != nil {
+		return nil, err
+	}
+	children := roots
+	if parentID != "" {
+		parent, ok := nodes[parentID]
+		if !ok {
+			return nil, gorm.ErrRecordNotFound
+		}
+		children = parent.Children
+	}
+	list := []*TreeNode{}
+	for _, node := range children {
+		n := *node
+		n.Children = nil
+		list = append(list, &n)
+	}
+	if parentID == "" {
+		return list, nil
+	}
+	channels := []Channels{}
+	if _, err := db.FindT(db.DBClient, new(Channels), &channels, db.M{"groupid=?": parentID, "removed=?": false}, "name", 0, -1, false); err != nil {
+		return nil, err
+	}
+	for _, channel := range channels {
+		name := channel.Name
+		if name == "" {
+			name = channel.MeMo
+		}
+		list = append(list, &TreeNode{
+			ID:       channel.ChannelID,
+			Name:     name,
+			Type:     GroupType(channel.ChannelID),
+			ParentID: parentID,
+			Channel:  true,
+			Status:   channel.Status,
+			Leaf:     true,
+		})
+	}
+	return list, nil
+}
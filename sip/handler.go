@@ -1,10 +1,15 @@
 package sipapi
 
 import (
-	"fmt"
+	"encoding/xml"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/panjjo/gosip/db"
+	"github.com/panjjo/gosip/m"
 	sip "github.com/panjjo/gosip/sip/s"
 	"github.com/panjjo/gosip/utils"
 	"github.com/sirupsen/logrus"
@@ -12,6 +17,7 @@ import (
 
 // MessageReceive 接收到的请求数据最外层，主要用来判断数据类型
 type MessageReceive struct {
+	XMLName xml.Name
 	CmdType string `xml:"CmdType"`
 	SN      int    `xml:"SN"`
 }
@@ -45,6 +51,14 @@ func handlerMessage(req *sip.Request, tx *sip.Transaction) {
 			return
 		}
 	}
+	if platform, ok := getPlatform(u.DeviceID); ok && platform.match(req.Source()) {
+		// 上级平台请求，先应答再异步查询
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", nil))
+		if message.XMLName.Local == "Query" {
+			go platform.handlerQuery(body)
+		}
+		return
+	}
 	switch message.CmdType {
 	case "Catalog":
 		// 设备列表
@@ -53,16 +67,49 @@ func handlerMessage(req *sip.Request, tx *sip.Transaction) {
 		return
 	case "Keepalive":
 		// heardbeat
-		if err := sipMessageKeepalive(u, body); err == nil {
+		err := sipMessageKeepalive(u, body)
+		if err == nil {
 			tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", nil))
-			// 心跳后同步注册设备列表信息
-			sipCatalog(u)
+			// 心跳后同步注册设备列表信息，检查设备订阅，订阅请求可能长时间无应答，不阻塞消息处理
+			if _, ok := _activeDevices.Get(u.DeviceID); ok {
+				go syncSubscriptions(u)
+			}
+			return
+		}
+		if errors.Is(err, errKeepaliveUnregistered) {
+			// 未注册设备的心跳拒绝，设备收到后重新注册
+			tx.Respond(sip.NewResponseFromRequest("", req, http.StatusNotFound, http.StatusText(http.StatusNotFound), nil))
 			return
 		}
 	case "RecordInfo":
 		// 设备音视频文件列表
 		sipMessageRecordInfo(u, body)
 		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", nil))
+		return
+	case "MediaStatus":
+		// 媒体通知，历史媒体文件发送结束
+		var callID string
+		if v, ok := req.CallID(); ok {
+			callID = string(*v)
+		}
+		sipMessageMediaStatus(u, callID, body)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", nil))
+		return
+	case "Alarm":
+		// 报警通知
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", nil))
+		sipMessageAlarm(u, body)
+		return
+	case "MobilePosition":
+		// 移动设备位置
+		sipMessageMobilePosition(u, body)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", nil))
+		return
+	case "PresetQuery":
+		// 预置位列表
+		sipMessagePresetQuery(u, body)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", nil))
+		return
 	case "DeviceInfo":
 		// 主设备信息
 		sipMessageDeviceInfo(u, body)
@@ -73,49 +120,199 @@ func handlerMessage(req *sip.Request, tx *sip.Transaction) {
 }
 
 func handlerRegister(req *sip.Request, tx *sip.Transaction) {
+	fromUser, ok := parserDevicesFromReqeust(req)
+	if !ok {
+		return
+	}
+	ip := sourceIP(fromUser.source)
+	if _lockouts.locked(fromUser.DeviceID, ip) {
+		// 多次认证失败，锁定期间拒绝注册
+		logrus.Warnln("register locked,id:", fromUser.DeviceID, "ip:", ip)
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusForbidden, http.StatusText(http.StatusForbidden), nil))
+		return
+	}
+	user := Devices{DeviceID: fromUser.DeviceID}
+	err := db.Get(db.DBClient, &user)
+	if (err == nil && user.Pending) || db.RecordNotFound(err) {
+		// 未知设备或待审核设备
+		if config.Auth.AutoRegister {
+			if !devicePending(user, fromUser, req, ip) {
+				tx.Respond(sip.NewResponseFromRequest("", req, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), nil))
+				return
+			}
+		} else if len(req.GetHeaders("Authorization")) > 0 {
+			// 设备不存在，只记录来源IP
+			logrus.Warnln("register device not found,id:", fromUser.DeviceID, "ip:", ip)
+			_lockouts.fail("", ip)
+		}
+		registerChallenge(req, tx, user.authAlgorithms(), false)
+		return
+	}
 	// 判断是否存在授权字段
 	if hdrs := req.GetHeaders("Authorization"); len(hdrs) > 0 {
-		fromUser, ok := parserDevicesFromReqeust(req)
-		if !ok {
-			return
-		}
-		user := Devices{DeviceID: fromUser.DeviceID}
-		if err := db.Get(db.DBClient, &user); err == nil {
+		if err == nil {
+			if !user.allowSource(ip) {
+				logrus.Warnln("register source not allowed,id:", user.DeviceID, "ip:", ip, "allow:", user.AllowCIDRs)
+				tx.Respond(sip.NewResponseFromRequest("", req, http.StatusForbidden, http.StatusText(http.StatusForbidden), nil))
+				return
+			}
 			if !user.Regist {
 				// 如果数据库里用户未激活，替换user数据
 				fromUser.ID = user.ID
 				fromUser.Name = user.Name
 				fromUser.PWD = user.PWD
+				fromUser.AllowCIDRs = user.AllowCIDRs
+				fromUser.AuthAlgorithms = user.AuthAlgorithms
 				user = fromUser
 			}
 			user.addr = fromUser.addr
 			authenticateHeader := hdrs[0].(*sip.GenericHeader)
 			auth := sip.AuthFromValue(authenticateHeader.Contents)
+			if !allowAlgorithm(user.authAlgorithms(), auth.Algorithm()) {
+				// 未开启的摘要算法，重新质询
+				logrus.Warnln("register algorithm not allowed,id:", user.DeviceID, "algorithm:", auth.Algorithm())
+				registerChallenge(req, tx, user.authAlgorithms(), false)
+				return
+			}
 			auth.SetPassword(user.PWD)
 			auth.SetUsername(user.DeviceID)
 			auth.SetMethod(string(req.Method()))
 			auth.SetURI(auth.Get("uri"))
 			if auth.CalcResponse() == auth.Get("response") {
+				switch status := _nonces.Check(auth.Nonce(), auth.NC()); status {
+				case sip.NonceValid:
+				case sip.NonceStale:
+					// nonce过期，设备使用新nonce重新注册即可
+					registerChallenge(req, tx, user.authAlgorithms(), true)
+					return
+				default:
+					logrus.Warnln("register nonce rejected,id:", user.DeviceID, "nonce:", auth.Nonce(), "nc:", auth.NC(), "status:", status)
+					registerChallenge(req, tx, user.authAlgorithms(), false)
+					return
+				}
 				// 验证成功
+				_lockouts.reset(user.DeviceID, ip)
 				// 记录活跃设备
 				user.source = fromUser.source
 				user.addr = fromUser.addr
+				user.TransPort = fromUser.TransPort
+				user.Algorithm = strings.ToUpper(auth.Algorithm())
+				expires := registerExpires(req)
+				if expires == 0 {
+					// 注销
+					logrus.Infoln("user unregist,id:", user.DeviceID)
+					tx.Respond(registerResponse(req, 0))
+					db.UpdateAll(db.DBClient, new(Devices), db.M{"deviceid=?": user.DeviceID}, db.M{"expires": 0, "expiresat": 0})
+					setDeviceOffline(user.DeviceID, m.DeviceStatusOFF)
+					return
+				}
+				// 注册视为一次心跳
+				user.ActiveAt = time.Now().Unix()
+				user.Expires = expires
+				user.ExpiresAt = user.ActiveAt + int64(expires)
 				_activeDevices.Store(user.DeviceID, user)
 				if !user.Regist {
 					// 第一次激活，保存数据库
 					user.Regist = true
 					db.DBClient.Save(&user)
 					logrus.Infoln("new user regist,id:", user.DeviceID)
+				} else {
+					db.UpdateAll(db.DBClient, new(Devices), db.M{"deviceid=?": user.DeviceID}, db.M{"expires": user.Expires, "expiresat": user.ExpiresAt, "algorithm": user.Algorithm})
 				}
-				tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", nil))
+				tx.Respond(registerResponse(req, expires))
+				// 重新注册后立即重试失败的订阅
+				clearSubscribeRetry(user.DeviceID)
 				// 注册成功后查询设备信息，获取制作厂商等信息
 				go notify(notifyDevicesRegister(user))
 				go sipDeviceInfo(fromUser)
 				return
 			}
+			// 认证失败
+			logrus.Warnln("register auth fail,id:", user.DeviceID, "ip:", ip)
+			_lockouts.fail(user.DeviceID, ip)
 		}
 	}
+	registerChallenge(req, tx, user.authAlgorithms(), false)
+}
+
+// 注册质询签发的nonce
+var _nonces *sip.NonceStore
+
+// nonceTTL 注册nonce有效期
+const nonceTTL = 5 * time.Minute
+
+// nonceMax 未清理的注册nonce上限，大量未完成的注册质询时丢弃最早签发的
+const nonceMax = 10000
+
+// registerChallenge 返回401质询，签发新的nonce，algorithms每种算法一个质询
+func registerChallenge(req *sip.Request, tx *sip.Transaction, algorithms []string, stale bool) {
 	resp := sip.NewResponseFromRequest("", req, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), nil)
-	resp.AppendHeader(&sip.GenericHeader{HeaderName: "WWW-Authenticate", Contents: fmt.Sprintf("Digest nonce=\"%s\", algorithm=MD5, realm=\"%s\",qop=\"auth\"", utils.RandString(32), _sysinfo.Region)})
+	nonce := _nonces.New()
+	for _, algorithm := range algorithms {
+		resp.AppendHeader(&sip.GenericHeader{HeaderName: "WWW-Authenticate", Contents: sip.Challenge(_sysinfo.Region, nonce, algorithm, stale)})
+	}
 	tx.Respond(resp)
 }
+
+// allowAlgorithm 摘要算法是否已开启
+func allowAlgorithm(algorithms []string, algorithm string) bool {
+	for _, v := range algorithms {
+		if strings.EqualFold(v, algorithm) {
+			return true
+		}
+	}
+	return false
+}
+
+// authAlgorithms 设备允许的摘要算法，未单独设置时使用配置
+func (d Devices) authAlgorithms() []string {
+	if d.AuthAlgorithms == "" {
+		return config.Auth.Algorithms
+	}
+	return strings.Split(d.AuthAlgorithms, ",")
+}
+
+// ParseAlgorithms 校验并格式化摘要算法列表，多个算法使用逗号分隔
+func ParseAlgorithms(algorithms string) (string, error) {
+	list := []string{}
+	for _, v := range strings.Split(algorithms, ",") {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		if !sip.ValidAlgorithm(v) {
+			return "", errors.New("algorithm not supported:" + v)
+		}
+		list = append(list, v)
+	}
+	return strings.Join(list, ","), nil
+}
+
+// defaultRegisterExpires 注册请求未携带有效期时使用的默认有效期，单位秒
+const defaultRegisterExpires = 3600
+
+// registerExpires 注册有效期，优先使用Expires头域，其次使用Contact的expires参数
+func registerExpires(req *sip.Request) int {
+	if hdrs := req.GetHeaders("Expires"); len(hdrs) > 0 {
+		if expires, ok := hdrs[0].(*sip.Expires); ok {
+			return int(*expires)
+		}
+	}
+	if contact, ok := req.Contact(); ok && contact.Params != nil {
+		if v, ok := contact.Params.Get("expires"); ok && v != nil {
+			if expires, err := strconv.Atoi(v.String()); err == nil && expires >= 0 {
+				return expires
+			}
+		}
+	}
+	return defaultRegisterExpires
+}
+
+// registerResponse 注册成功响应，携带有效期和用于设备校时的Date头域(GB28181格式)
+func registerResponse(req *sip.Request, expires int) *sip.Response {
+	resp := sip.NewResponseFromRequest("", req, http.StatusOK, "OK", nil)
+	e := sip.Expires(expires)
+	resp.AppendHeader(&e)
+	resp.AppendHeader(&sip.GenericHeader{HeaderName: "Date", Contents: time.Now().Format("2006-01-02T15:04:05.000")})
+	return resp
+}
@@ -1,9 +1,11 @@
 package sipapi
 
 import (
+	"errors"
 	"time"
 
 	"github.com/panjjo/gosip/db"
+	"github.com/panjjo/gosip/m"
 	"github.com/panjjo/gosip/utils"
 	"github.com/sirupsen/logrus"
 )
@@ -17,6 +19,9 @@ type MessageNotify struct {
 	Info     string `xml:"Info"`
 }
 
+// errKeepaliveUnregistered 设备未注册或注册已过期，心跳不能使设备上线，需要重新注册
+var errKeepaliveUnregistered = errors.New("device not registered")
+
 func sipMessageKeepalive(u Devices, body []byte) error {
 	message := &MessageNotify{}
 	if err := utils.XMLDecode(body, message); err != nil {
@@ -25,27 +30,110 @@ func sipMessageKeepalive(u Devices, body []byte) error {
 	}
 	device, ok := _activeDevices.Get(u.DeviceID)
 	if !ok {
-		device = Devices{DeviceID: u.DeviceID}
-		if err := db.Get(db.DBClient, &device); err != nil {
-			logrus.Warnln("Device Keepalive not found ", u.DeviceID, err)
-		}
+		// 服务重启后内存中无活跃设备，注册未过期的设备通过心跳恢复
+		device, ok = restoreActiveDevice(u)
 	}
-	if message.Status == "OK" {
-		device.ActiveAt = time.Now().Unix()
-		_activeDevices.Store(u.DeviceID, u)
-	} else {
-		device.ActiveAt = -1
-		_activeDevices.Delete(u.DeviceID)
+	if !ok || (device.ExpiresAt > 0 && device.ExpiresAt < time.Now().Unix()) {
+		// 注销或注册过期的设备只有重新注册才能上线
+		logrus.Warnln("Device Keepalive not registered ", u.DeviceID)
+		return errKeepaliveUnregistered
 	}
+	if message.Status != "OK" {
+		// 设备主动上报异常
+		deviceOffline(device, message.Status)
+		return nil
+	}
+	device.ActiveAt = time.Now().Unix()
+	u.ActiveAt = device.ActiveAt
+	u.KeepaliveInterval = device.KeepaliveInterval
+	u.Expires = device.Expires
+	u.ExpiresAt = device.ExpiresAt
+	_activeDevices.Store(u.DeviceID, u)
 	go notify(notifyDevicesAcitve(u.DeviceID, message.Status))
 	_, err := db.UpdateAll(db.DBClient, new(Devices), map[string]interface{}{"deviceid=?": u.DeviceID}, Devices{
-		Host:     u.Host,
-		Port:     u.Port,
-		Rport:    u.Rport,
-		RAddr:    u.RAddr,
-		Source:   u.Source,
-		URIStr:   u.URIStr,
-		ActiveAt: device.ActiveAt,
+		Host:      u.Host,
+		Port:      u.Port,
+		Rport:     u.Rport,
+		TransPort: u.TransPort,
+		RAddr:     u.RAddr,
+		Source:    u.Source,
+		URIStr:    u.URIStr,
+		ActiveAt:  device.ActiveAt,
 	})
 	return err
 }
+
+// restoreActiveDevice 从数据库加载注册未过期的设备，来源地址需在设备允许的网段内
+func restoreActiveDevice(u Devices) (Devices, bool) {
+	device := Devices{DeviceID: u.DeviceID}
+	if err := db.Get(db.DBClient, &device); err != nil {
+		return device, false
+	}
+	if !device.Regist || device.Pending || device.ExpiresAt < time.Now().Unix() || !device.allowSource(sourceIP(u.source)) {
+		return device, false
+	}
+	logrus.Infoln("Device Keepalive restore registered device ", u.DeviceID, "expiresat:", device.ExpiresAt)
+	return device, true
+}
+
+// keepaliveTimeout 设备心跳超时时间，心跳周期使用设备设置，未设置时使用配置
+func keepaliveTimeout(device Devices) int64 {
+	interval := device.KeepaliveInterval
+	if interval <= 0 {
+		interval = config.Keepalive.Interval
+	}
+	return int64(interval * config.Keepalive.Count)
+}
+
+// SetKeepaliveInterval 更新在线设备的心跳周期
+func SetKeepaliveInterval(deviceID string, interval int) {
+	if device, ok := _activeDevices.Get(deviceID); ok {
+		device.KeepaliveInterval = interval
+		_activeDevices.Store(deviceID, device)
+	}
+}
+
+// CheckDevicesActive 定时检查活跃设备，连续多个心跳周期未收到心跳的设备置为离线
+func CheckDevicesActive() {
+	now := time.Now().Unix()
+	_activeDevices.Range(func(key, value any) bool {
+		device := value.(Devices)
+		if now-device.ActiveAt > keepaliveTimeout(device) {
+			logrus.Infoln("device keepalive timeout,id:", device.DeviceID, "active:", device.ActiveAt)
+			deviceOffline(device, m.DeviceStatusOFF)
+		} else if device.ExpiresAt > 0 && now > device.ExpiresAt {
+			logrus.Infoln("device register expired,id:", device.DeviceID, "expiresat:", device.ExpiresAt)
+			deviceOffline(device, m.DeviceStatusOFF)
+		}
+		return true
+	})
+}
+
+// deviceOffline 设备离线，移出活跃设备，设备及其通道置为离线并通知
+func deviceOffline(device Devices, status string) {
+	if active, ok := _activeDevices.Get(device.DeviceID); ok && (active.ActiveAt > device.ActiveAt || active.ExpiresAt > device.ExpiresAt) {
+		// 检查期间收到心跳或重新注册
+		return
+	}
+	setDeviceOffline(device.DeviceID, status)
+}
+
+// setDeviceOffline 设备置为离线
+func setDeviceOffline(deviceID, status string) {
+	device := Devices{DeviceID: deviceID}
+	_activeDevices.Delete(device.DeviceID)
+	removeSubscriptions(device.DeviceID)
+	db.UpdateAll(db.DBClient, new(Devices), db.M{"deviceid=?": device.DeviceID}, db.M{"active": -1})
+	go notify(notifyDevicesAcitve(device.DeviceID, status))
+
+	channels := []Channels{}
+	db.FindT(db.DBClient, new(Channels), &channels, db.M{"deviceid=?": device.DeviceID, "status=?": m.DeviceStatusON}, "", 0, -1, false)
+	if len(channels) == 0 {
+		return
+	}
+	db.UpdateAll(db.DBClient, new(Channels), db.M{"deviceid=?": device.DeviceID, "status=?": m.DeviceStatusON}, db.M{"status": m.DeviceStatusOFF})
+	for _, channel := range channels {
+		channel.Status = m.DeviceStatusOFF
+		go notify(notifyChannelsActive(channel))
+	}
+}
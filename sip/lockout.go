@@ -0,0 +1,217 @@
+package sipapi
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 注册失败锁定类型
+const (
+	// LockoutTypeDevice 按设备编号锁定
+	LockoutTypeDevice = "device"
+	// LockoutTypeIP 按来源IP锁定
+	LockoutTypeIP = "ip"
+)
+
+// RegisterLockout 注册失败记录，失败次数达到配置上限后锁定，锁定期间注册返回403
+type RegisterLockout struct {
+	// Type 锁定类型 device设备编号 ip来源IP
+	Type string `json:"type"`
+	// Key 设备编号或来源IP
+	Key string `json:"key"`
+	// Fails 统计周期内失败次数
+	Fails int `json:"fails"`
+	// FirstAt 统计周期内首次失败时间
+	FirstAt int64 `json:"firstat"`
+	// LockedUntil 锁定截止时间，0未锁定
+	LockedUntil int64 `json:"lockeduntil"`
+}
+
+// registerLockouts 注册失败记录 key=type:key
+type registerLockouts struct {
+	items map[string]*RegisterLockout
+	l     sync.Mutex
+}
+
+var _lockouts = &registerLockouts{items: map[string]*RegisterLockout{}}
+
+// lockoutMax 注册失败记录上限，超出时优先丢弃最早的未锁定记录
+const lockoutMax = 10000
+
+func lockoutKey(t, key string) string {
+	return t + ":" + key
+}
+
+// sourceIP 请求来源IP
+func sourceIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// locked 设备编号或来源IP是否处于锁定中
+func (r *registerLockouts) locked(deviceID, ip string) bool {
+	now := time.Now().Unix()
+	r.l.Lock()
+	defer r.l.Unlock()
+	for _, key := range []string{lockoutKey(LockoutTypeDevice, deviceID), lockoutKey(LockoutTypeIP, ip)} {
+		if item, ok := r.items[key]; ok && item.LockedUntil > now {
+			return true
+		}
+	}
+	return false
+}
+
+// fail 记录一次认证失败，设备编号为空时只记录来源IP
+func (r *registerLockouts) fail(deviceID, ip string) {
+	now := time.Now().Unix()
+	window := int64(config.Auth.Lockout)
+	r.l.Lock()
+	defer r.l.Unlock()
+	for t, key := range map[string]string{LockoutTypeDevice: deviceID, LockoutTypeIP: ip} {
+		if key == "" {
+			continue
+		}
+		item, ok := r.items[lockoutKey(t, key)]
+		if !ok && len(r.items) >= lockoutMax {
+			r.evict(now, window)
+		}
+		if !ok || item.expired(now, window) {
+			// 超过统计周期重新计数
+			item = &RegisterLockout{Type: t, Key: key, FirstAt: now}
+			r.items[lockoutKey(t, key)] = item
+		}
+		item.Fails++
+		if item.Fails >= config.Auth.MaxFails && item.LockedUntil <= now {
+			item.LockedUntil = now + window
+		}
+	}
+}
+
+// expired 统计周期已过且未锁定
+func (item *RegisterLockout) expired(now, window int64) bool {
+	return item.LockedUntil <= now && now-item.FirstAt > window
+}
+
+// evict 记录数达到上限，清理过期记录，仍超出时丢弃最早的记录，优先保留锁定中的记录
+func (r *registerLockouts) evict(now, window int64) {
+	var oldest string
+	oldestLocked := true
+	for k, item := range r.items {
+		if item.expired(now, window) {
+			delete(r.items, k)
+			continue
+		}
+		locked := item.LockedUntil > now
+		if oldest == "" || (oldestLocked && !locked) || (oldestLocked == locked && item.FirstAt < r.items[oldest].FirstAt) {
+			oldest, oldestLocked = k, locked
+		}
+	}
+	if len(r.items) >= lockoutMax && oldest != "" {
+		delete(r.items, oldest)
+	}
+}
+
+// CleanRegisterLockouts 定时清理过期的注册失败记录
+func CleanRegisterLockouts() {
+	now := time.Now().Unix()
+	window := int64(config.Auth.Lockout)
+	_lockouts.l.Lock()
+	defer _lockouts.l.Unlock()
+	for k, item := range _lockouts.items {
+		if item.expired(now, window) {
+			delete(_lockouts.items, k)
+		}
+	}
+}
+
+// reset 认证成功，清除设备编号和来源IP的失败记录
+func (r *registerLockouts) reset(deviceID, ip string) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	delete(r.items, lockoutKey(LockoutTypeDevice, deviceID))
+	delete(r.items, lockoutKey(LockoutTypeIP, ip))
+}
+
+// GetRegisterLockouts 注册失败记录列表，清理已过期记录
+func GetRegisterLockouts() []RegisterLockout {
+	now := time.Now().Unix()
+	window := int64(config.Auth.Lockout)
+	_lockouts.l.Lock()
+	defer _lockouts.l.Unlock()
+	list := []RegisterLockout{}
+	for k, item := range _lockouts.items {
+		if item.expired(now, window) {
+			delete(_lockouts.items, k)
+			continue
+		}
+		list = append(list, *item)
+	}
+	return list
+}
+
+// ClearRegisterLockout 解除锁定，deviceID和ip均为空时清除全部
+func ClearRegisterLockout(deviceID, ip string) {
+	_lockouts.l.Lock()
+	defer _lockouts.l.Unlock()
+	if deviceID == "" && ip == "" {
+		_lockouts.items = map[string]*RegisterLockout{}
+		return
+	}
+	if deviceID != "" {
+		delete(_lockouts.items, lockoutKey(LockoutTypeDevice, deviceID))
+	}
+	if ip != "" {
+		delete(_lockouts.items, lockoutKey(LockoutTypeIP, ip))
+	}
+}
+
+// allowSource 来源IP是否在设备允许的网段内，未配置时不限制
+func (d Devices) allowSource(ip string) bool {
+	if strings.TrimSpace(d.AllowCIDRs) == "" {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, v := range strings.Split(d.AllowCIDRs, ",") {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(v))
+		if err == nil && ipnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs 校验并格式化网段列表，多个网段使用逗号分隔
+func ParseCIDRs(cidrs string) (string, error) {
+	list := []string{}
+	for _, v := range strings.Split(cidrs, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			// 单个IP
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(v)
+		if err != nil {
+			return "", err
+		}
+		list = append(list, ipnet.String())
+	}
+	return strings.Join(list, ","), nil
+}
@@ -19,6 +19,12 @@ const (
 	NotifyMethodChannelsActive = "channels.active"
 	// NotifyMethodRecordStop 视频录制结束
 	NotifyMethodRecordStop = "records.stop"
+	// NotifyMethodStreamsEnd 回放或下载的媒体文件发送结束
+	NotifyMethodStreamsEnd = "streams.end"
+	// NotifyMethodAlarmsNew 设备报警通知
+	NotifyMethodAlarmsNew = "alarms.new"
+	// NotifyMethodCatalogsSync 设备目录同步结果通知
+	NotifyMethodCatalogsSync = "catalogs.sync"
 )
 
 // Notify 消息通知结构
@@ -83,3 +89,30 @@ func notifyRecordStop(url string, req url.Values) *Notify {
 		Data:   d,
 	}
 }
+
+func notifyStreamsEnd(s *Streams) *Notify {
+	return &Notify{
+		Method: NotifyMethodStreamsEnd,
+		Data: map[string]interface{}{
+			"streamid":  s.StreamID,
+			"channelid": s.ChannelID,
+			"deviceid":  s.DeviceID,
+			"t":         s.T,
+			"fileid":    s.FileID,
+		},
+	}
+}
+
+func notifyAlarmsNew(a Alarms) *Notify {
+	return &Notify{
+		Method: NotifyMethodAlarmsNew,
+		Data:   a,
+	}
+}
+
+func notifyCatalogSync(result CatalogSyncResult) *Notify {
+	return &Notify{
+		Method: NotifyMethodCatalogsSync,
+		Data:   result,
+	}
+}
@@ -0,0 +1,69 @@
+package sipapi
+
+import (
+	"regexp"
+
+	"github.com/panjjo/gosip/db"
+	sip "github.com/panjjo/gosip/sip/s"
+	"github.com/sirupsen/logrus"
+)
+
+var deviceIDRegexp = regexp.MustCompile(`^\d{20}$`)
+
+// ValidDeviceID 是否为20位国标编码
+func ValidDeviceID(id string) bool {
+	return deviceIDRegexp.MatchString(id)
+}
+
+// pendingMax 待审核设备数上限，达到后不再记录新的未知设备
+const pendingMax = 1000
+
+// devicePending 开启自动注册时记录未知设备为待审核，已存在时更新来源地址
+// 新增待审核设备计入来源IP的注册失败次数，待审核设备数达到上限时返回false
+func devicePending(user, fromUser Devices, req *sip.Request, ip string) bool {
+	if !ValidDeviceID(fromUser.DeviceID) {
+		logrus.Warnln("register pending invalid id:", fromUser.DeviceID, "source:", fromUser.Source)
+		return true
+	}
+	if hdrs := req.GetHeaders("User-Agent"); len(hdrs) > 0 {
+		switch h := hdrs[0].(type) {
+		case *sip.UserAgentHeader:
+			fromUser.Manufacturer = string(*h)
+		case *sip.GenericHeader:
+			fromUser.Manufacturer = h.Contents
+		}
+	}
+	if user.ID == 0 {
+		var total int64
+		if err := db.DBClient.Model(new(Devices)).Where("pending = ?", true).Count(&total).Error; err != nil {
+			logrus.Errorln("count pending devices fail", err)
+			return false
+		}
+		if total >= pendingMax {
+			logrus.Warnln("pending devices reach max,id:", fromUser.DeviceID, "source:", fromUser.Source, "max:", pendingMax)
+			return false
+		}
+		// 同一来源大量未知设备注册时锁定来源IP
+		_lockouts.fail("", ip)
+		fromUser.Pending = true
+		fromUser.Name = fromUser.DeviceID
+		if err := db.Create(db.DBClient, &fromUser); err != nil {
+			logrus.Errorln("save pending device fail,id:", fromUser.DeviceID, err)
+			return true
+		}
+		logrus.Infoln("new pending device,id:", fromUser.DeviceID, "source:", fromUser.Source)
+		return true
+	}
+	db.UpdateAll(db.DBClient, new(Devices), db.M{"deviceid=?": user.DeviceID}, Devices{
+		Region:       fromUser.Region,
+		Host:         fromUser.Host,
+		Port:         fromUser.Port,
+		Rport:        fromUser.Rport,
+		TransPort:    fromUser.TransPort,
+		RAddr:        fromUser.RAddr,
+		Source:       fromUser.Source,
+		URIStr:       fromUser.URIStr,
+		Manufacturer: fromUser.Manufacturer,
+	})
+	return true
+}
@@ -1,8 +1,10 @@
 package sipapi
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -14,8 +16,11 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// PlayTimeout 点播INVITE等待最终响应的最长时间，超时后CANCEL
+const PlayTimeout = 30 * time.Second
+
 // sip 请求播放
-func SipPlay(data *Streams) (*Streams, error) {
+func SipPlay(ctx context.Context, data *Streams) (*Streams, error) {
 
 	channel := Channels{ChannelID: data.ChannelID}
 	if err := db.Get(db.DBClient, &channel); err != nil {
@@ -33,8 +38,8 @@ func SipPlay(data *Streams) (*Streams, error) {
 		// 拉流
 
 	default:
-		// 推流模式要求设备在线且活跃
-		if time.Now().Unix()-channel.Active > 30*60 || channel.Status != m.DeviceStatusON {
+		// 推流模式要求设备在线，设备心跳超时后由CheckDevicesActive置为离线
+		if channel.Status != m.DeviceStatusON {
 			return nil, errors.New("通道已离线")
 		}
 		user, ok := _activeDevices.Get(channel.DeviceID)
@@ -44,7 +49,12 @@ func SipPlay(data *Streams) (*Streams, error) {
 		// GB28181推流
 		if data.StreamID == "" {
 			ssrcLock.Lock()
-			data.ssrc = getSSRC(data.T)
+			// 国标ssrc首位 0实时 1历史(回放、下载)
+			t := data.T
+			if t > 1 {
+				t = 1
+			}
+			data.ssrc = getSSRC(t)
 			data.StreamID = ssrc2stream(data.ssrc)
 
 			// 成功后保存
@@ -53,10 +63,19 @@ func SipPlay(data *Streams) (*Streams, error) {
 		}
 
 		var err error
-		data, err = sipPlayPush(data, channel, user)
+		data, err = sipPlayPush(ctx, data, channel, user)
 		if err != nil {
 			return nil, fmt.Errorf("获取视频失败:%v", err)
 		}
+		switch data.T {
+		case 1:
+			// 回放从开始时间以正常倍速播放
+			data.Scale = 1
+			data.setPosition(0)
+		case 2:
+			// 下载按下载倍速估算进度
+			data.setPosition(0)
+		}
 	}
 
 	data.HTTP = fmt.Sprintf("%s/rtp/%s/hls.m3u8", config.Media.HTTP, data.StreamID)
@@ -75,16 +94,20 @@ func SipPlay(data *Streams) (*Streams, error) {
 
 var ssrcLock *sync.Mutex
 
-func sipPlayPush(data *Streams, channel Channels, device Devices) (*Streams, error) {
+func sipPlayPush(ctx context.Context, data *Streams, channel Channels, device Devices) (*Streams, error) {
 	var (
 		s sdp.Session
 		b []byte
 	)
 	name := "Play"
 	protocal := "TCP/RTP/AVP"
-	if data.T == 1 {
+	switch data.T {
+	case 1:
 		name = "Playback"
 		protocal = "RTP/RTCP"
+	case 2:
+		name = "Download"
+		protocal = "RTP/RTCP"
 	}
 
 	video := sdp.Media{
@@ -103,6 +126,9 @@ func sipPlayPush(data *Streams, channel Channels, device Devices) (*Streams, err
 	video.AddAttribute("rtpmap", "96", "PS/90000")
 	video.AddAttribute("rtpmap", "98", "H264/90000")
 	video.AddAttribute("rtpmap", "97", "MPEG4/90000")
+	if data.T == 2 {
+		video.AddAttribute("downloadspeed", strconv.Itoa(int(data.Scale)))
+	}
 
 	// defining message
 	msg := &sdp.Message{
@@ -124,7 +150,7 @@ func sipPlayPush(data *Streams, channel Channels, device Devices) (*Streams, err
 		Medias: []sdp.Media{video},
 		SSRC:   data.ssrc,
 	}
-	if data.T == 1 {
+	if data.T != 0 {
 		msg.URI = fmt.Sprintf("%s:0", channel.ChannelID)
 	}
 
@@ -136,46 +162,33 @@ func sipPlayPush(data *Streams, channel Channels, device Devices) (*Streams, err
 	channel.addr = &sip.Address{URI: uri}
 	_serverDevices.addr.Params.Add("tag", sip.String{Str: utils.RandString(20)})
 	hb := sip.NewHeaderBuilder().SetTo(channel.addr).SetFrom(_serverDevices.addr).AddVia(&sip.ViaHop{
-		Params: sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+		Transport: device.TransPort,
+		Params:    sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
 	}).SetContentType(&sip.ContentTypeSDP).SetMethod(sip.INVITE).SetContact(_serverDevices.addr)
 	req := sip.NewRequest("", sip.INVITE, channel.addr.URI, sip.DefaultSipVersion, hb.Build(), b)
 	req.SetDestination(device.source)
 	req.AppendHeader(&sip.GenericHeader{HeaderName: "Subject", Contents: fmt.Sprintf("%s:%s,%s:%s", channel.ChannelID, data.StreamID, _serverDevices.DeviceID, data.StreamID)})
 	req.SetRecipient(channel.addr.URI)
-	tx, err := srv.Request(req)
+	ctx, cancel := context.WithTimeout(ctx, PlayTimeout)
+	defer cancel()
+	response, err := sipRequest(ctx, req)
 	if err != nil {
-		logrus.Warningln("sipPlayPush fail.id:", device.DeviceID, channel.ChannelID, "err:", err)
+		logrus.Warningln("sipPlayPush response fail.id:", device.DeviceID, channel.ChannelID, "err:", err)
 		return data, err
 	}
-	// response
-	response, err := sipResponse(tx)
+	dialog, err := srv.NewDialogFromResponse(response)
 	if err != nil {
-		logrus.Warningln("sipPlayPush response fail.id:", device.DeviceID, channel.ChannelID, "err:", err)
+		logrus.Warningln("sipPlayPush dialog fail.id:", device.DeviceID, channel.ChannelID, "err:", err)
 		return data, err
 	}
-	data.Resp = response
 	// ACK
-	tx.Request(sip.NewRequestFromResponse(sip.ACK, response))
-
-	callid, _ := response.CallID()
-	data.CallID = string(*callid)
-
-	cseq, _ := response.CSeq()
-	if cseq != nil {
-		data.CseqNo = cseq.SeqNo
-	}
-
-	from, _ := response.From()
-	to, _ := response.To()
-	for k, v := range to.Params.Items() {
-		data.Ttag[k] = v.String()
-	}
-	for k, v := range from.Params.Items() {
-		data.Ftag[k] = v.String()
+	if err = dialog.Ack(response); err != nil {
+		logrus.Warningln("sipPlayPush ack fail.id:", device.DeviceID, channel.ChannelID, "err:", err)
 	}
+	data.setDialog(dialog)
 	data.Status = 0
 
-	return data, err
+	return data, nil
 }
 
 // sip 停止播放
@@ -188,26 +201,23 @@ func SipStopPlay(ssrc string) {
 	play := data.(*Streams)
 	if play.StreamType == m.StreamTypePush {
 		// 推流，需要发送关闭请求
-		resp := play.Resp
-		u, ok := _activeDevices.Load(play.DeviceID)
+		user, ok := _activeDevices.Get(play.DeviceID)
 		if !ok {
 			return
 		}
-		user := u.(Devices)
-		req := sip.NewRequestFromResponse(sip.BYE, resp)
-		req.SetDestination(user.source)
-		tx, err := srv.Request(req)
-		if err != nil {
-			logrus.Warningln("sipStopPlay bye fail.id:", play.DeviceID, play.ChannelID, "err:", err)
+		dialog := play.getDialog(user)
+		tx, err := dialog.Bye()
+		if err == nil {
+			_, err = sipResponse(tx)
 		}
-		_, err = sipResponse(tx)
 		if err != nil {
-			logrus.Warnln("sipStopPlay response fail", err)
+			logrus.Warnln("sipStopPlay bye fail.id:", play.DeviceID, play.ChannelID, "err:", err)
 			play.Msg = err.Error()
 		} else {
 			play.Status = 1
 			play.Stop = true
 		}
+		play.CseqNo = dialog.LocalSeq
 		db.Save(db.DBClient, play)
 	}
 	StreamList.Response.Delete(ssrc)
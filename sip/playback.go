@@ -0,0 +1,169 @@
+package sipapi
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/panjjo/gosip/db"
+	"github.com/panjjo/gosip/m"
+	sip "github.com/panjjo/gosip/sip/s"
+	"github.com/sirupsen/logrus"
+)
+
+// 回放支持的倍速
+var playbackScales = map[float64]bool{0.25: true, 0.5: true, 1: true, 2: true, 4: true}
+
+// PlaybackState 回放控制后的回放状态
+type PlaybackState struct {
+	StreamID string `json:"streamid"`
+	// Position 回放进度，相对回放开始时间的秒数
+	Position int64 `json:"position"`
+	// Scale 回放倍速
+	Scale float64 `json:"scale"`
+	// Paused 是否暂停
+	Paused bool `json:"paused"`
+	// Finished 媒体文件是否发送完成
+	Finished bool `json:"finished"`
+}
+
+// CurrentPosition 当前回放进度，相对回放开始时间的秒数，调用方需持有流锁
+func (s *Streams) CurrentPosition() int64 {
+	if s.Paused || s.PosAt == 0 {
+		return s.Position
+	}
+	scale := s.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return s.Position + int64(float64(time.Now().Unix()-s.PosAt)*scale)
+}
+
+// setPosition 更新回放进度
+func (s *Streams) setPosition(pos int64) {
+	s.Position = pos
+	s.PosAt = time.Now().Unix()
+}
+
+// playbackState 保存并返回回放状态，调用方需持有流锁，只更新回放相关字段，不覆盖其他并发修改
+func (s *Streams) playbackState() *PlaybackState {
+	db.UpdateAll(db.DBClient, new(Streams), db.M{"streamid=?": s.StreamID}, db.M{
+		"position": s.Position,
+		"posat":    s.PosAt,
+		"scale":    s.Scale,
+		"paused":   s.Paused,
+		"rtspseq":  s.RtspSeq,
+		"cseqno":   s.CseqNo,
+	})
+	return &PlaybackState{StreamID: s.StreamID, Position: s.CurrentPosition(), Scale: s.Scale, Paused: s.Paused, Finished: s.Finished}
+}
+
+// getPlayback 获取进行中的回放流
+func getPlayback(streamID string) (*Streams, error) {
+	data, ok := StreamList.Response.Load(streamID)
+	if !ok {
+		return nil, errors.New("视频流不存在或已关闭")
+	}
+	stream := data.(*Streams)
+	if stream.T != 1 || stream.StreamType != m.StreamTypePush {
+		return nil, errors.New("仅支持设备推流的回放")
+	}
+	return stream, nil
+}
+
+// sipPlaybackControl 发送对话内INFO回放控制请求，调用方需持有流锁，保证CSeq顺序
+func sipPlaybackControl(ctx context.Context, stream *Streams, body func(cseq uint32) []byte) error {
+	device, ok := _activeDevices.Get(stream.DeviceID)
+	if !ok {
+		return errors.New("设备已离线")
+	}
+	dialog := stream.getDialog(device)
+	stream.RtspSeq++
+	req := dialog.NewRequest(sip.INFO, &sip.ContentTypeMANSRTSP, body(stream.RtspSeq))
+	_, err := sipRequest(ctx, req)
+	stream.CseqNo = dialog.LocalSeq
+	if err != nil {
+		logrus.Warnln("sipPlaybackControl fail.id:", stream.DeviceID, stream.ChannelID, stream.StreamID, "err:", err)
+		return err
+	}
+	return nil
+}
+
+// SipPlaybackPause 暂停回放
+func SipPlaybackPause(ctx context.Context, streamID string) (*PlaybackState, error) {
+	stream, err := getPlayback(streamID)
+	if err != nil {
+		return nil, err
+	}
+	stream.l.Lock()
+	defer stream.l.Unlock()
+	if err := sipPlaybackControl(ctx, stream, sip.GetMANSRTSPPause); err != nil {
+		return nil, err
+	}
+	stream.setPosition(stream.CurrentPosition())
+	stream.Paused = true
+	return stream.playbackState(), nil
+}
+
+// SipPlaybackResume 恢复回放
+func SipPlaybackResume(ctx context.Context, streamID string) (*PlaybackState, error) {
+	stream, err := getPlayback(streamID)
+	if err != nil {
+		return nil, err
+	}
+	stream.l.Lock()
+	defer stream.l.Unlock()
+	err = sipPlaybackControl(ctx, stream, func(cseq uint32) []byte {
+		return sip.GetMANSRTSPPlay(cseq, -1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	stream.setPosition(stream.Position)
+	stream.Paused = false
+	return stream.playbackState(), nil
+}
+
+// SipPlaybackSeek 回放跳转，pos为相对回放开始时间的秒数
+func SipPlaybackSeek(ctx context.Context, streamID string, pos int64) (*PlaybackState, error) {
+	stream, err := getPlayback(streamID)
+	if err != nil {
+		return nil, err
+	}
+	stream.l.Lock()
+	defer stream.l.Unlock()
+	if pos < 0 || (!stream.E.IsZero() && pos > stream.E.Unix()-stream.S.Unix()) {
+		return nil, errors.New("跳转位置超出回放范围")
+	}
+	err = sipPlaybackControl(ctx, stream, func(cseq uint32) []byte {
+		return sip.GetMANSRTSPPlay(cseq, pos)
+	})
+	if err != nil {
+		return nil, err
+	}
+	stream.setPosition(pos)
+	stream.Paused = false
+	return stream.playbackState(), nil
+}
+
+// SipPlaybackScale 设置回放倍速
+func SipPlaybackScale(ctx context.Context, streamID string, scale float64) (*PlaybackState, error) {
+	if !playbackScales[scale] {
+		return nil, errors.New("倍速仅支持0.25,0.5,1,2,4")
+	}
+	stream, err := getPlayback(streamID)
+	if err != nil {
+		return nil, err
+	}
+	stream.l.Lock()
+	defer stream.l.Unlock()
+	err = sipPlaybackControl(ctx, stream, func(cseq uint32) []byte {
+		return sip.GetMANSRTSPScale(cseq, scale)
+	})
+	if err != nil {
+		return nil, err
+	}
+	stream.setPosition(stream.CurrentPosition())
+	stream.Scale = scale
+	return stream.playbackState(), nil
+}
@@ -0,0 +1,79 @@
+package sipapi
+
+import (
+	"time"
+
+	"github.com/panjjo/gosip/db"
+	"github.com/panjjo/gosip/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Positions 移动设备位置历史
+type Positions struct {
+	db.DBModel
+	// ChannelID 通道编号
+	ChannelID string `json:"channelid" gorm:"column:channelid"`
+	// DeviceID 设备编号
+	DeviceID string `json:"deviceid" gorm:"column:deviceid"`
+	// Time 位置上报时间
+	Time int64 `json:"time" gorm:"column:time"`
+	// Longitude 经度
+	Longitude float64 `json:"longitude" gorm:"column:longitude"`
+	// Latitude 纬度
+	Latitude float64 `json:"latitude" gorm:"column:latitude"`
+	// Speed 速度(km/h)
+	Speed float64 `json:"speed" gorm:"column:speed"`
+	// Direction 方向，正北方向顺时针夹角
+	Direction float64 `json:"direction" gorm:"column:direction"`
+	// Altitude 海拔高度(m)
+	Altitude float64 `json:"altitude" gorm:"column:altitude"`
+}
+
+// MessageMobilePosition 移动设备位置通知
+type MessageMobilePosition struct {
+	CmdType   string  `xml:"CmdType"`
+	SN        int     `xml:"SN"`
+	DeviceID  string  `xml:"DeviceID"`
+	Time      string  `xml:"Time"`
+	Longitude float64 `xml:"Longitude"`
+	Latitude  float64 `xml:"Latitude"`
+	Speed     float64 `xml:"Speed"`
+	Direction float64 `xml:"Direction"`
+	Altitude  float64 `xml:"Altitude"`
+}
+
+// sipMessageMobilePosition 移动设备位置通知，保存历史并更新通道最新位置
+func sipMessageMobilePosition(u Devices, body []byte) error {
+	message := &MessageMobilePosition{}
+	if err := utils.XMLDecode(body, message); err != nil {
+		logrus.Errorln("Message Unmarshal xml err:", err, "body:", string(body))
+		return err
+	}
+	position := Positions{
+		ChannelID: message.DeviceID,
+		DeviceID:  u.DeviceID,
+		Time:      time.Now().Unix(),
+		Longitude: message.Longitude,
+		Latitude:  message.Latitude,
+		Speed:     message.Speed,
+		Direction: message.Direction,
+		Altitude:  message.Altitude,
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04:05", message.Time, time.Local); err == nil {
+		position.Time = t.Unix()
+	}
+	if err := db.Create(db.DBClient, &position); err != nil {
+		logrus.Errorln("save position fail", u.DeviceID, message.DeviceID, err)
+		return err
+	}
+	// 仅更新较新的位置，避免乱序上报覆盖
+	_, err := db.UpdateAll(db.DBClient, new(Channels), db.M{"channelid=?": message.DeviceID, "positionat<=?": position.Time}, db.M{
+		"longitude":  position.Longitude,
+		"latitude":   position.Latitude,
+		"speed":      position.Speed,
+		"direction":  position.Direction,
+		"altitude":   position.Altitude,
+		"positionat": position.Time,
+	})
+	return err
+}
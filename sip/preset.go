@@ -0,0 +1,204 @@
+package sipapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	sip "github.com/panjjo/gosip/sip/s"
+	"github.com/panjjo/gosip/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Preset 预置位
+type Preset struct {
+	// PresetID 预置位编号
+	PresetID int `xml:"PresetID" json:"presetid"`
+	// PresetName 预置位名称
+	PresetName string `xml:"PresetName" json:"name"`
+}
+
+// MessagePresetQueryResponse 预置位查询返回结构
+type MessagePresetQueryResponse struct {
+	CmdType    string `xml:"CmdType"`
+	SN         int    `xml:"SN"`
+	DeviceID   string `xml:"DeviceID"`
+	PresetList struct {
+		Num  int      `xml:"Num,attr"`
+		Item []Preset `xml:"Item"`
+	} `xml:"PresetList"`
+}
+
+type presetList struct {
+	resp chan []Preset
+	data []Preset
+	l    *sync.Mutex
+}
+
+// 当前查询预置位的通道集合
+var _presetList *sync.Map
+
+// SipPresetQuery 查询通道预置位列表
+func SipPresetQuery(ctx context.Context, channel *Channels) ([]Preset, error) {
+	sn := utils.RandInt(100000, 999999)
+	presetKey := fmt.Sprintf("%s%d", channel.ChannelID, sn)
+	info := &presetList{resp: make(chan []Preset, 1), data: []Preset{}, l: &sync.Mutex{}}
+	_presetList.Store(presetKey, info)
+	defer _presetList.Delete(presetKey)
+	if err := sipChannelMessage(ctx, channel, sip.GetPresetQueryXML(channel.ChannelID, sn)); err != nil {
+		return nil, err
+	}
+	tick := time.NewTicker(10 * time.Second)
+	defer tick.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-info.resp:
+		return res, nil
+	case <-tick.C:
+		// 10秒未完成返回当前获取到的数据
+		info.l.Lock()
+		defer info.l.Unlock()
+		if len(info.data) > 0 {
+			return info.data, nil
+		}
+		return nil, errors.New("获取数据超时")
+	}
+}
+
+func sipMessagePresetQuery(u Devices, body []byte) error {
+	message := &MessagePresetQueryResponse{}
+	if err := utils.XMLDecode(body, message); err != nil {
+		logrus.Errorln("Message Unmarshal xml err:", err, "body:", string(body))
+		return err
+	}
+	presetKey := fmt.Sprintf("%s%d", message.DeviceID, message.SN)
+	list, ok := _presetList.Load(presetKey)
+	if !ok {
+		return errors.New("presetlist channel not found")
+	}
+	info := list.(*presetList)
+	info.l.Lock()
+	defer info.l.Unlock()
+	info.data = append(info.data, message.PresetList.Item...)
+	if len(info.data) >= message.PresetList.Num {
+		// 获取到完整数据
+		select {
+		case info.resp <- info.data:
+		default:
+		}
+	}
+	return nil
+}
+
+// 预置位操作
+const (
+	PresetSet  = "set"
+	PresetCall = "call"
+	PresetDel  = "delete"
+)
+
+var presetCodes = map[string]byte{
+	PresetSet:  sip.PTZCodeSetPreset,
+	PresetCall: sip.PTZCodeCallPreset,
+	PresetDel:  sip.PTZCodeDelPreset,
+}
+
+// SipPreset 设置、调用、删除预置位
+func SipPreset(ctx context.Context, channel *Channels, action string, presetID int) error {
+	code, ok := presetCodes[action]
+	if !ok {
+		return errors.New("预置位操作错误")
+	}
+	if presetID < 1 || presetID > 255 {
+		return errors.New("预置位编号错误")
+	}
+	cmd := sip.PTZCmd(code, 0, byte(presetID), 0)
+	return sipChannelMessage(ctx, channel, sip.GetPTZXML(channel.ChannelID, cmd))
+}
+
+// 巡航操作
+const (
+	CruiseAdd   = "add"
+	CruiseDel   = "delete"
+	CruiseSpeed = "speed"
+	CruiseDwell = "dwell"
+	CruiseStart = "start"
+	CruiseStop  = "stop"
+)
+
+// SipCruise 巡航轨迹设置与启停
+// add/delete 使用presetID，presetID为0时删除整条巡航；speed/dwell 使用value，最大4095
+func SipCruise(ctx context.Context, channel *Channels, action string, cruiseID, presetID, value int) error {
+	if cruiseID < 0 || cruiseID > 255 {
+		return errors.New("巡航组号错误")
+	}
+	var cmd string
+	switch action {
+	case CruiseAdd, CruiseDel:
+		if presetID < 0 || presetID > 255 || (action == CruiseAdd && presetID == 0) {
+			return errors.New("预置位编号错误")
+		}
+		code := sip.PTZCodeAddCruise
+		if action == CruiseDel {
+			code = sip.PTZCodeDelCruise
+		}
+		cmd = sip.PTZCmd(code, byte(cruiseID), byte(presetID), 0)
+	case CruiseSpeed, CruiseDwell:
+		if value < 0 || value > 0xFFF {
+			return errors.New("参数值错误")
+		}
+		code := sip.PTZCodeCruiseSpeed
+		if action == CruiseDwell {
+			code = sip.PTZCodeCruiseDwell
+		}
+		cmd = sip.PTZCmd(code, byte(cruiseID), byte(value&0xFF), byte(value>>8))
+	case CruiseStart:
+		cmd = sip.PTZCmd(sip.PTZCodeStartCruise, byte(cruiseID), 0, 0)
+	case CruiseStop:
+		// 巡航停止使用云台停止指令
+		cmd = sip.PTZCmd(sip.PTZCodeStop, 0, 0, 0)
+	default:
+		return errors.New("巡航操作错误")
+	}
+	return sipChannelMessage(ctx, channel, sip.GetPTZXML(channel.ChannelID, cmd))
+}
+
+// 自动扫描操作
+const (
+	ScanStart = "start"
+	ScanLeft  = "left"
+	ScanRight = "right"
+	ScanSpeed = "speed"
+	ScanStop  = "stop"
+)
+
+var scanModes = map[string]byte{
+	ScanStart: 0,
+	ScanLeft:  1,
+	ScanRight: 2,
+}
+
+// SipScan 自动扫描边界、速度设置与启停
+func SipScan(ctx context.Context, channel *Channels, action string, scanID, value int) error {
+	if scanID < 0 || scanID > 255 {
+		return errors.New("扫描组号错误")
+	}
+	var cmd string
+	switch action {
+	case ScanStart, ScanLeft, ScanRight:
+		cmd = sip.PTZCmd(sip.PTZCodeScan, byte(scanID), scanModes[action], 0)
+	case ScanSpeed:
+		if value < 0 || value > 0xFFF {
+			return errors.New("参数值错误")
+		}
+		cmd = sip.PTZCmd(sip.PTZCodeScanSpeed, byte(scanID), byte(value&0xFF), byte(value>>8))
+	case ScanStop:
+		cmd = sip.PTZCmd(sip.PTZCodeStop, 0, 0, 0)
+	default:
+		return errors.New("扫描操作错误")
+	}
+	return sipChannelMessage(ctx, channel, sip.GetPTZXML(channel.ChannelID, cmd))
+}
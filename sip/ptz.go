@@ -0,0 +1,99 @@
+package sipapi
+
+import (
+	"context"
+	"errors"
+
+	sip "github.com/panjjo/gosip/sip/s"
+	"github.com/sirupsen/logrus"
+)
+
+// PTZControl 云台控制参数
+type PTZControl struct {
+	// Direction 转动方向 up,down,left,right,upleft,upright,downleft,downright 为空不转动
+	Direction string
+	// Zoom 变倍 in 放大，out 缩小，为空不变倍
+	Zoom string
+	// Speed 速度 0-255，变倍速度取高4位
+	Speed int
+}
+
+var ptzDirections = map[string]byte{
+	"":          sip.PTZCodeStop,
+	"stop":      sip.PTZCodeStop,
+	"up":        sip.PTZCodeUp,
+	"down":      sip.PTZCodeDown,
+	"left":      sip.PTZCodeLeft,
+	"right":     sip.PTZCodeRight,
+	"upleft":    sip.PTZCodeUp | sip.PTZCodeLeft,
+	"upright":   sip.PTZCodeUp | sip.PTZCodeRight,
+	"downleft":  sip.PTZCodeDown | sip.PTZCodeLeft,
+	"downright": sip.PTZCodeDown | sip.PTZCodeRight,
+}
+
+var ptzZooms = map[string]byte{
+	"":     sip.PTZCodeStop,
+	"stop": sip.PTZCodeStop,
+	"in":   sip.PTZCodeZoomIn,
+	"out":  sip.PTZCodeZoomOut,
+}
+
+// cmd 生成PTZ指令，方向和变倍都为空时为停止指令
+func (p PTZControl) cmd() (string, error) {
+	direction, ok := ptzDirections[p.Direction]
+	if !ok {
+		return "", errors.New("方向参数错误")
+	}
+	zoom, ok := ptzZooms[p.Zoom]
+	if !ok {
+		return "", errors.New("变倍参数错误")
+	}
+	if p.Speed < 0 || p.Speed > 255 {
+		return "", errors.New("速度参数错误")
+	}
+	var hspeed, vspeed, zspeed byte
+	speed := byte(p.Speed)
+	if direction&(sip.PTZCodeLeft|sip.PTZCodeRight) > 0 {
+		hspeed = speed
+	}
+	if direction&(sip.PTZCodeUp|sip.PTZCodeDown) > 0 {
+		vspeed = speed
+	}
+	if zoom > 0 {
+		zspeed = speed >> 4
+	}
+	return sip.PTZCmd(direction|zoom, hspeed, vspeed, zspeed), nil
+}
+
+// SipPTZ 云台控制
+func SipPTZ(ctx context.Context, channel *Channels, ptz PTZControl) error {
+	cmd, err := ptz.cmd()
+	if err != nil {
+		return err
+	}
+	return sipChannelMessage(ctx, channel, sip.GetPTZXML(channel.ChannelID, cmd))
+}
+
+// sipChannelMessage 向通道所属设备发送MESSAGE请求
+func sipChannelMessage(ctx context.Context, channel *Channels, body []byte) error {
+	device, ok := _activeDevices.Get(channel.DeviceID)
+	if !ok {
+		return errors.New("设备不在线")
+	}
+	uri, err := sip.ParseURI(channel.URIStr)
+	if err != nil {
+		return errors.New("通道地址错误")
+	}
+	channel.addr = &sip.Address{URI: uri}
+	hb := sip.NewHeaderBuilder().SetTo(channel.addr).SetFrom(_serverDevices.addr).AddVia(&sip.ViaHop{
+		Transport: device.TransPort,
+		Params:    sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+	}).SetContentType(&sip.ContentTypeXML).SetMethod(sip.MESSAGE)
+	req := sip.NewRequest("", sip.MESSAGE, channel.addr.URI, sip.DefaultSipVersion, hb.Build(), body)
+	req.SetDestination(device.source)
+	if _, err := sipRequest(ctx, req); err != nil {
+		logrus.Warnln("sipChannelMessage fail.id:", device.DeviceID, channel.ChannelID, "err:", err)
+		return err
+	}
+	return nil
+}
@@ -1,9 +1,9 @@
 package sipapi
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net/http"
 	"sort"
 	"sync"
 	"time"
@@ -14,7 +14,7 @@ import (
 )
 
 // 获取录像文件列表
-func SipRecordList(to *Channels, start, end int64) (*Records, error) {
+func SipRecordList(ctx context.Context, to *Channels, start, end int64) (*Records, error) {
 	sn := utils.RandInt(100000, 999999)
 	resp := make(chan Records, 1)
 	defer close(resp)
@@ -28,20 +28,19 @@ func SipRecordList(to *Channels, start, end int64) (*Records, error) {
 	_recordList.Store(recordKey, recordList{channelid: to.ChannelID, resp: resp, data: [][]int64{}, l: &sync.Mutex{}, s: start, e: end})
 	defer _recordList.Delete(recordKey)
 	hb := sip.NewHeaderBuilder().SetTo(to.addr).SetFrom(_serverDevices.addr).AddVia(&sip.ViaHop{
-		Params: sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+		Transport: device.TransPort,
+		Params:    sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
 	}).SetContentType(&sip.ContentTypeXML).SetMethod(sip.MESSAGE)
 	req := sip.NewRequest("", sip.MESSAGE, to.addr.URI, sip.DefaultSipVersion, hb.Build(), sip.GetRecordInfoXML(to.ChannelID, sn, start, end))
 	req.SetDestination(device.source)
-	tx, err := srv.Request(req)
-	if err != nil {
+	if _, err := sipRequest(ctx, req); err != nil {
 		return nil, err
 	}
-	response := tx.GetResponse()
-	if response.StatusCode() != http.StatusOK {
-		return nil, errors.New(response.Reason())
-	}
 	tick := time.NewTicker(10 * time.Second)
+	defer tick.Stop()
 	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case res := <-resp:
 		return &res, nil
 	case <-tick.C:
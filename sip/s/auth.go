@@ -2,13 +2,54 @@ package sip
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/panjjo/gosip/utils"
+)
+
+// 摘要算法 RFC 8760，带-sess后缀时A1包含nonce和cnonce
+const (
+	AlgorithmMD5       = "MD5"
+	AlgorithmSHA256    = "SHA-256"
+	AlgorithmSHA512256 = "SHA-512-256"
+
+	algorithmSessSuffix = "-SESS"
 )
 
-// Authorization currently only Digest and MD5
+// algorithmHash 摘要算法对应的hash函数，sess表示是否为-sess算法
+func algorithmHash(algorithm string) (newHash func() hash.Hash, sess bool, ok bool) {
+	algorithm = strings.ToUpper(algorithm)
+	if strings.HasSuffix(algorithm, algorithmSessSuffix) {
+		sess = true
+		algorithm = strings.TrimSuffix(algorithm, algorithmSessSuffix)
+	}
+	switch algorithm {
+	case AlgorithmMD5:
+		return md5.New, sess, true
+	case AlgorithmSHA256:
+		return sha256.New, sess, true
+	case AlgorithmSHA512256:
+		return sha512.New512_256, sess, true
+	}
+	return nil, false, false
+}
+
+// ValidAlgorithm 是否为支持的摘要算法
+func ValidAlgorithm(algorithm string) bool {
+	_, _, ok := algorithmHash(algorithm)
+	return ok
+}
+
+// Authorization Digest认证，支持MD5、SHA-256、SHA-512-256及其-sess算法
 type Authorization struct {
 	realm     string
 	nonce     string
@@ -69,6 +110,21 @@ func AuthFromValue(value string) *Authorization {
 	return auth
 }
 
+// Algorithm Algorithm
+func (auth *Authorization) Algorithm() string {
+	return auth.algorithm
+}
+
+// Nonce Nonce
+func (auth *Authorization) Nonce() string {
+	return auth.nonce
+}
+
+// NC NC
+func (auth *Authorization) NC() string {
+	return auth.nc
+}
+
 // Get Get
 func (auth *Authorization) Get(key string) string {
 	return auth.Data[key]
@@ -95,6 +151,25 @@ func (auth *Authorization) SetMethod(method string) *Authorization {
 	return auth
 }
 
+// Qop Qop
+func (auth *Authorization) Qop() string {
+	return auth.qop
+}
+
+// SetNC SetNC
+func (auth *Authorization) SetNC(nc string) *Authorization {
+	auth.nc = nc
+
+	return auth
+}
+
+// SetCNonce SetCNonce
+func (auth *Authorization) SetCNonce(cnonce string) *Authorization {
+	auth.cnonce = cnonce
+
+	return auth
+}
+
 // SetPassword SetPassword
 func (auth *Authorization) SetPassword(password string) *Authorization {
 	auth.password = password
@@ -104,7 +179,8 @@ func (auth *Authorization) SetPassword(password string) *Authorization {
 
 // CalcResponse CalcResponse
 func (auth *Authorization) CalcResponse() string {
-	auth.response = CalcResponse(
+	auth.response = CalcResponseAlgorithm(
+		auth.algorithm,
 		auth.username,
 		auth.realm,
 		auth.password,
@@ -136,26 +212,43 @@ func (auth *Authorization) String() string {
 	if auth.qop == "auth" {
 		str += fmt.Sprintf(`,qop=%s,nc=%s,cnonce="%s"`, auth.qop, auth.nc, auth.cnonce)
 	}
+	if opaque, ok := auth.other["opaque"]; ok {
+		str += fmt.Sprintf(`,opaque="%s"`, opaque)
+	}
 
 	return str
 }
 
 // CalcResponse Authorization response https://www.ietf.org/rfc/rfc2617.txt
 func CalcResponse(username, realm, password, method, uri, nonce, qop, cnonce, nc string) string {
+	return CalcResponseAlgorithm(AlgorithmMD5, username, realm, password, method, uri, nonce, qop, cnonce, nc)
+}
+
+// CalcResponseAlgorithm 指定摘要算法计算response https://www.rfc-editor.org/rfc/rfc8760，不支持的算法返回空
+func CalcResponseAlgorithm(algorithm, username, realm, password, method, uri, nonce, qop, cnonce, nc string) string {
+	newHash, sess, ok := algorithmHash(algorithm)
+	if !ok {
+		return ""
+	}
 	calcA1 := func() string {
-		encoder := md5.New()
+		encoder := newHash()
 		encoder.Write([]byte(username + ":" + realm + ":" + password))
+		if sess {
+			a1 := hex.EncodeToString(encoder.Sum(nil))
+			encoder = newHash()
+			encoder.Write([]byte(a1 + ":" + nonce + ":" + cnonce))
+		}
 
 		return hex.EncodeToString(encoder.Sum(nil))
 	}
 	calcA2 := func() string {
-		encoder := md5.New()
+		encoder := newHash()
 		encoder.Write([]byte(method + ":" + uri))
 
 		return hex.EncodeToString(encoder.Sum(nil))
 	}
 
-	encoder := md5.New()
+	encoder := newHash()
 	encoder.Write([]byte(calcA1() + ":" + nonce + ":"))
 	if qop != "" {
 		encoder.Write([]byte(nc + ":" + cnonce + ":" + qop + ":"))
@@ -163,3 +256,111 @@ func CalcResponse(username, realm, password, method, uri, nonce, qop, cnonce, nc
 	encoder.Write([]byte(calcA2()))
 	return hex.EncodeToString(encoder.Sum(nil))
 }
+
+// NonceStatus nonce校验结果
+type NonceStatus int
+
+const (
+	// NonceValid nonce有效
+	NonceValid NonceStatus = iota
+	// NonceUnknown nonce不存在，非本服务签发或已清理
+	NonceUnknown
+	// NonceStale nonce已过期，应使用stale=true重新质询
+	NonceStale
+	// NonceReused nonce或nc重复使用，可能为重放请求
+	NonceReused
+)
+
+// nonceItem 已签发的nonce
+type nonceItem struct {
+	created time.Time
+	// nc 最后使用的nc，未携带qop时仅允许使用一次
+	nc   uint64
+	used bool
+}
+
+// NonceStore 签发的nonce记录，用于校验nonce有效期及nc防重放
+type NonceStore struct {
+	ttl    time.Duration
+	max    int
+	nonces map[string]*nonceItem
+	// order 按签发顺序记录nonce，清理和超出上限时从最早的开始删除
+	order []string
+	l     sync.Mutex
+}
+
+// NewNonceStore 创建nonce记录，ttl为nonce有效期，max为未清理nonce上限，超出时丢弃最早签发的
+func NewNonceStore(ttl time.Duration, max int) *NonceStore {
+	s := &NonceStore{ttl: ttl, max: max, nonces: map[string]*nonceItem{}}
+	go s.clean()
+	return s
+}
+
+// New 签发新的nonce
+func (s *NonceStore) New() string {
+	nonce := utils.RandString(32)
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.nonces[nonce] = &nonceItem{created: time.Now()}
+	s.order = append(s.order, nonce)
+	for len(s.order) > s.max {
+		s.drop()
+	}
+	return nonce
+}
+
+// drop 删除最早签发的nonce
+func (s *NonceStore) drop() {
+	delete(s.nonces, s.order[0])
+	s.order[0] = ""
+	s.order = s.order[1:]
+}
+
+// clean 定时清理过期nonce，过期后保留一个有效期用于返回stale
+func (s *NonceStore) clean() {
+	tick := time.NewTicker(s.ttl)
+	for range tick.C {
+		s.l.Lock()
+		for len(s.order) > 0 && time.Since(s.nonces[s.order[0]].created) > 2*s.ttl {
+			s.drop()
+		}
+		s.l.Unlock()
+	}
+}
+
+// Check 校验nonce及nc，nc必须递增，未携带nc时nonce只能使用一次
+func (s *NonceStore) Check(nonce, nc string) NonceStatus {
+	s.l.Lock()
+	defer s.l.Unlock()
+	item, ok := s.nonces[nonce]
+	if !ok {
+		return NonceUnknown
+	}
+	if time.Since(item.created) > s.ttl {
+		return NonceStale
+	}
+	if nc == "" {
+		if item.used {
+			return NonceReused
+		}
+		item.used = true
+		return NonceValid
+	}
+	n, err := strconv.ParseUint(nc, 16, 64)
+	if err != nil || n <= item.nc {
+		return NonceReused
+	}
+	item.nc = n
+	item.used = true
+	return NonceValid
+}
+
+// Challenge WWW-Authenticate质询内容，stale为true时表示nonce过期，设备可直接使用新nonce重新计算
+// 支持多种算法时每种算法一个质询，按优先级依次添加到响应中
+func Challenge(realm, nonce, algorithm string, stale bool) string {
+	str := fmt.Sprintf(`Digest realm="%s",nonce="%s",algorithm=%s,qop="auth"`, realm, nonce, algorithm)
+	if stale {
+		str += ",stale=true"
+	}
+	return str
+}
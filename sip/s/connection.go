@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -89,6 +90,100 @@ func newUDPConnection(baseConn net.Conn) Connection {
 	return conn
 }
 
+// tcpConnection 面向流的连接，每个连接只对应一个远端，消息通过Content-Length分帧
+type tcpConnection struct {
+	*connection
+	reader *bufio.Reader
+}
+
+func newTCPConnection(baseConn net.Conn) *tcpConnection {
+	return &tcpConnection{
+		connection: &connection{
+			baseConn: baseConn,
+			laddr:    baseConn.LocalAddr(),
+			raddr:    baseConn.RemoteAddr(),
+			logKey:   "tcpConnection",
+		},
+		reader: bufio.NewReaderSize(baseConn, int(bufferSize)),
+	}
+}
+
+// readMessage 从流中读取一条完整的sip消息，消息头结束后按Content-Length读取消息体
+// 单条消息不超过bufferSize，超出时返回错误，由调用方关闭连接
+func (conn *tcpConnection) readMessage() ([]byte, error) {
+	var (
+		buffer bytes.Buffer
+		length int
+	)
+	for {
+		// 单行超过读缓冲时返回bufio.ErrBufferFull
+		data, err := conn.reader.ReadSlice('\n')
+		if err == io.EOF && buffer.Len() == 0 && len(data) == 0 {
+			// 对端关闭连接
+			return nil, err
+		}
+		if err != nil {
+			return nil, utils.NewError(err, conn.logKey, "readMessage", conn.raddr.String())
+		}
+		line := string(data)
+		if buffer.Len() == 0 && strings.TrimSpace(line) == "" {
+			// 消息之间的心跳空行 RFC 5626 CRLF keep-alive
+			continue
+		}
+		if buffer.Len()+len(line) > int(bufferSize) {
+			return nil, utils.NewError(nil, conn.logKey, "readMessage", "header too large", conn.raddr.String())
+		}
+		buffer.WriteString(line)
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			// 消息头结束
+			break
+		}
+		if idx := strings.Index(line, ":"); idx > 0 {
+			name := strings.ToLower(strings.TrimSpace(line[:idx]))
+			if name == "content-length" || name == "l" {
+				length, err = strconv.Atoi(strings.TrimSpace(line[idx+1:]))
+				if err != nil || length < 0 {
+					return nil, utils.NewError(err, conn.logKey, "readMessage", "invalid content-length", line)
+				}
+			}
+		}
+	}
+	if buffer.Len()+length > int(bufferSize) {
+		return nil, utils.NewError(nil, conn.logKey, "readMessage", "content-length too large", length, conn.raddr.String())
+	}
+	if length > 0 {
+		body := make([]byte, length)
+		if _, err := io.ReadFull(conn.reader, body); err != nil {
+			return nil, utils.NewError(err, conn.logKey, "readMessage", "read body", conn.raddr.String())
+		}
+		buffer.Write(body)
+	}
+	return buffer.Bytes(), nil
+}
+
+func (conn *tcpConnection) ReadFrom(buf []byte) (num int, raddr net.Addr, err error) {
+	data, err := conn.readMessage()
+	if err != nil {
+		return 0, conn.raddr, err
+	}
+	if len(data) > len(buf) {
+		return 0, conn.raddr, utils.NewError(nil, conn.logKey, "readfrom", "message too large", len(data))
+	}
+	num = copy(buf, data)
+	return num, conn.raddr, nil
+}
+
+// WriteTo tcp连接已绑定远端，忽略raddr
+func (conn *tcpConnection) WriteTo(buf []byte, raddr net.Addr) (num int, err error) {
+	num, err = conn.baseConn.Write(buf)
+	if err != nil {
+		return num, utils.NewError(err, conn.logKey, "writeTo", conn.laddr.String(), conn.raddr.String())
+	}
+	logrus.Tracef("writeTo %d , %s -> %s \n %s", num, conn.laddr, conn.raddr, string(buf[:num]))
+	return num, err
+}
+
 func (conn *connection) Read(buf []byte) (int, error) {
 	var (
 		num int
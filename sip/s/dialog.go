@@ -0,0 +1,290 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Dialog INVITE 建立的对话 RFC 3261 12
+// 记录本端/远端tag、路由集、远端目标和CSeq，用来发送对话内请求
+type Dialog struct {
+	// CallID 对话Call-ID
+	CallID CallID
+	// Local 本端地址，From，包含tag
+	Local *Address
+	// Remote 远端地址，To，包含tag
+	Remote *Address
+	// RemoteTarget 远端目标，取自Contact
+	RemoteTarget *URI
+	// RouteSet 路由集，取自Record-Route
+	RouteSet []*URI
+	// LocalSeq 本端CSeq
+	LocalSeq uint32
+	// InviteSeq 建立(或最后一次更新)对话的INVITE CSeq，ACK使用
+	InviteSeq uint32
+	// Transport 传输协议
+	Transport string
+	// Destination 对端地址
+	Destination net.Addr
+
+	srv *Server
+	mu  sync.Mutex
+	// ack 最后发送的ACK，收到2xx重传时重发
+	ack      *Request
+	ackTimer *time.Timer
+}
+
+// dialogKey 对话标识 RFC 3261 12
+func dialogKey(callID, localTag, remoteTag string) string {
+	return callID + "|" + localTag + "|" + remoteTag
+}
+
+func (d *Dialog) key() string {
+	return dialogKey(string(d.CallID), d.LocalTag(), d.RemoteTag())
+}
+
+// register 记录已确认的对话，UAS在64*T1内停止重传2xx，之后移除
+func (d *Dialog) register(ack *Request) {
+	key := d.key()
+	d.mu.Lock()
+	d.ack = ack
+	if d.ackTimer != nil {
+		d.ackTimer.Stop()
+	}
+	d.ackTimer = time.AfterFunc(64*d.srv.txs.timers.T1, func() {
+		d.unregister(key)
+	})
+	d.mu.Unlock()
+	d.srv.dialogs.Store(key, d)
+}
+
+func (d *Dialog) unregister(key string) {
+	if v, ok := d.srv.dialogs.Load(key); ok && v == d {
+		d.srv.dialogs.Delete(key)
+	}
+}
+
+// ackRetransmission 没有事务的INVITE 2xx为重传，重发对话的ACK RFC 3261 13.2.2.4
+func (s *Server) ackRetransmission(res *Response) bool {
+	if res.StatusCode() < http.StatusOK || res.StatusCode() >= http.StatusMultipleChoices {
+		return false
+	}
+	cseq, ok := res.CSeq()
+	if !ok || cseq.MethodName != INVITE {
+		return false
+	}
+	callID, ok := res.CallID()
+	if !ok {
+		return false
+	}
+	from, ok := res.From()
+	if !ok {
+		return false
+	}
+	to, ok := res.To()
+	if !ok {
+		return false
+	}
+	if from.Params == nil || to.Params == nil {
+		return false
+	}
+	var localTag, remoteTag string
+	if tag, ok := from.Params.Get("tag"); ok && tag != nil {
+		localTag = tag.String()
+	}
+	if tag, ok := to.Params.Get("tag"); ok && tag != nil {
+		remoteTag = tag.String()
+	}
+	v, ok := s.dialogs.Load(dialogKey(string(*callID), localTag, remoteTag))
+	if !ok {
+		return false
+	}
+	d := v.(*Dialog)
+	d.mu.Lock()
+	ack := d.ack
+	match := cseq.SeqNo == d.InviteSeq
+	d.mu.Unlock()
+	if ack == nil || !match {
+		return false
+	}
+	logrus.Traceln("receive 2xx retransmission, resend ack, callid:", *callID)
+	if err := d.write(ack); err != nil {
+		logrus.Warnln("resend ack fail, callid:", *callID, err)
+	}
+	return true
+}
+
+// write 对话内请求不创建事务直接发送
+func (d *Dialog) write(req *Request) error {
+	conn, err := d.srv.getConn(d.Transport, d.Destination)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo([]byte(req.String()), req.Destination())
+	return err
+}
+
+// NewDialog 通过已保存的对话信息恢复对话
+func (s *Server) NewDialog(callID CallID, local, remote *Address, target *URI, localSeq uint32, transport string, dest net.Addr) *Dialog {
+	return &Dialog{
+		CallID:       callID,
+		Local:        local,
+		Remote:       remote,
+		RemoteTarget: target,
+		RouteSet:     []*URI{},
+		LocalSeq:     localSeq,
+		InviteSeq:    localSeq,
+		Transport:    transport,
+		Destination:  dest,
+		srv:          s,
+	}
+}
+
+// NewDialogFromResponse 通过INVITE的2xx响应创建对话(UAC) RFC 3261 12.1.2
+func (s *Server) NewDialogFromResponse(res *Response) (*Dialog, error) {
+	if res.StatusCode() < http.StatusOK || res.StatusCode() >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("dialog must create from 2xx response, status:%d", res.StatusCode())
+	}
+	callID, ok := res.CallID()
+	if !ok {
+		return nil, fmt.Errorf("missing required 'Call-ID' header")
+	}
+	from, ok := res.From()
+	if !ok {
+		return nil, fmt.Errorf("missing required 'From' header")
+	}
+	to, ok := res.To()
+	if !ok {
+		return nil, fmt.Errorf("missing required 'To' header")
+	}
+	if to.Params == nil || !to.Params.Has("tag") {
+		return nil, fmt.Errorf("missing remote tag in 'To' header")
+	}
+	cseq, ok := res.CSeq()
+	if !ok {
+		return nil, fmt.Errorf("missing required 'CSeq' header")
+	}
+	d := &Dialog{
+		CallID:      *callID,
+		Local:       NewAddressFromFromHeader(from),
+		Remote:      &Address{DisplayName: to.DisplayName, URI: to.Address.Clone(), Params: to.Params.Clone()},
+		RouteSet:    []*URI{},
+		LocalSeq:    cseq.SeqNo,
+		InviteSeq:   cseq.SeqNo,
+		Transport:   res.Transport(),
+		Destination: res.Source(),
+		srv:         s,
+	}
+	d.RemoteTarget = d.Remote.URI.Clone()
+	d.updateTarget(res)
+	// UAC 路由集为Record-Route的倒序
+	hdrs := res.GetHeaders("Record-Route")
+	for i := len(hdrs) - 1; i >= 0; i-- {
+		addresses := hdrs[i].(*RecordRouteHeader).Addresses
+		for j := len(addresses) - 1; j >= 0; j-- {
+			d.RouteSet = append(d.RouteSet, addresses[j].Clone())
+		}
+	}
+	return d, nil
+}
+
+// updateTarget 使用响应中的Contact更新远端目标 RFC 3261 12.2.1.2
+func (d *Dialog) updateTarget(res *Response) {
+	if contact, ok := res.Contact(); ok && contact.Address != nil {
+		d.RemoteTarget = contact.Address.Clone()
+	}
+}
+
+// RemoteTag 远端tag
+func (d *Dialog) RemoteTag() string {
+	if tag, ok := d.Remote.Params.Get("tag"); ok && tag != nil {
+		return tag.String()
+	}
+	return ""
+}
+
+// LocalTag 本端tag
+func (d *Dialog) LocalTag() string {
+	if tag, ok := d.Local.Params.Get("tag"); ok && tag != nil {
+		return tag.String()
+	}
+	return ""
+}
+
+// NewRequest 生成对话内请求 RFC 3261 12.2.1.1，除ACK外CSeq递增
+func (d *Dialog) NewRequest(method RequestMethod, contentType *ContentType, body []byte) *Request {
+	d.mu.Lock()
+	seq := d.InviteSeq
+	if method != ACK {
+		d.LocalSeq++
+		seq = d.LocalSeq
+		if method == INVITE {
+			d.InviteSeq = seq
+		}
+	}
+	d.mu.Unlock()
+
+	hb := NewHeaderBuilder().SetToWithParam(d.Remote).SetFrom(d.Local).AddVia(&ViaHop{
+		Transport: d.Transport,
+		Params:    NewParams().Add("branch", String{Str: GenerateBranch()}),
+	}).SetMethod(method).SetCallID(&d.CallID).SetSeqNo(uint(seq)).SetContact(d.Local)
+	if contentType != nil {
+		hb.SetContentType(contentType)
+	}
+	req := NewRequest("", method, d.RemoteTarget.Clone(), DefaultSipVersion, hb.Build(), body)
+	if len(d.RouteSet) > 0 {
+		uris := make([]*URI, 0, len(d.RouteSet))
+		for _, u := range d.RouteSet {
+			uris = append(uris, u.Clone())
+		}
+		req.AppendHeader(&RouteHeader{Addresses: uris})
+	}
+	if len(body) == 0 {
+		req.SetBody([]byte{}, true)
+	}
+	req.SetDestination(d.Destination)
+	return req
+}
+
+// Ack 确认INVITE或re-INVITE的2xx响应
+func (d *Dialog) Ack(res *Response) error {
+	d.mu.Lock()
+	d.updateTarget(res)
+	d.mu.Unlock()
+	req := d.NewRequest(ACK, nil, nil)
+	if viaHop, ok := req.ViaHop(); ok {
+		viaHop.Host = d.srv.host.String()
+		viaHop.Port = d.srv.transportPort(d.Transport)
+	}
+	if err := d.write(req); err != nil {
+		return err
+	}
+	d.register(req)
+	return nil
+}
+
+// Bye 结束对话
+func (d *Dialog) Bye() (*Transaction, error) {
+	d.mu.Lock()
+	if d.ackTimer != nil {
+		d.ackTimer.Stop()
+	}
+	d.mu.Unlock()
+	d.unregister(d.key())
+	return d.srv.Request(d.NewRequest(BYE, nil, nil))
+}
+
+// Info 发送对话内INFO请求
+func (d *Dialog) Info(contentType *ContentType, body []byte) (*Transaction, error) {
+	return d.srv.Request(d.NewRequest(INFO, contentType, body))
+}
+
+// ReInvite 发送re-INVITE，收到2xx后需调用Ack
+func (d *Dialog) ReInvite(body []byte) (*Transaction, error) {
+	return d.srv.Request(d.NewRequest(INVITE, &ContentTypeSDP, body))
+}
@@ -23,8 +23,8 @@ const (
 	BYE      RequestMethod = "BYE"
 	REGISTER RequestMethod = "REGISTER"
 	OPTIONS  RequestMethod = "OPTIONS"
-	// SUBSCRIBE RequestMethod = "SUBSCRIBE"
-	// NOTIFY  RequestMethod = "NOTIFY"
+	SUBSCRIBE RequestMethod = "SUBSCRIBE"
+	NOTIFY RequestMethod = "NOTIFY"
 	// REFER   RequestMethod = "REFER"
 	INFO    RequestMethod = "INFO"
 	MESSAGE RequestMethod = "MESSAGE"
@@ -2,6 +2,7 @@ package sip
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -78,6 +79,9 @@ var ContentTypeSDP = ContentType("application/sdp")
 // ContentTypeXML XML contenttype
 var ContentTypeXML = ContentType("Application/MANSCDP+xml")
 
+// ContentTypeMANSRTSP 回放控制 contenttype
+var ContentTypeMANSRTSP = ContentType("Application/MANSRTSP")
+
 var (
 	// CatalogXML 获取设备列表xml样式
 	CatalogXML = `<?xml version="1.0" encoding="GB2312"?>
@@ -107,23 +111,199 @@ var (
 <DeviceID>%s</DeviceID>
 </Query>
 `
+	// PresetQueryXML 查询预置位xml样式
+	PresetQueryXML = `<?xml version="1.0" encoding="GB2312"?>
+<Query>
+<CmdType>PresetQuery</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+</Query>
+`
+	// AlarmSubscribeXML 报警订阅xml样式，订阅全部级别、方式的报警
+	AlarmSubscribeXML = `<?xml version="1.0" encoding="GB2312"?>
+<Query>
+<CmdType>Alarm</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<StartAlarmPriority>0</StartAlarmPriority>
+<EndAlarmPriority>0</EndAlarmPriority>
+<AlarmMethod>0</AlarmMethod>
+</Query>
+`
+	// MobilePositionSubscribeXML 移动设备位置订阅xml样式
+	MobilePositionSubscribeXML = `<?xml version="1.0" encoding="GB2312"?>
+<Query>
+<CmdType>MobilePosition</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<Interval>%d</Interval>
+</Query>
+`
+	// AlarmResponseXML 报警通知应答xml样式
+	AlarmResponseXML = `<?xml version="1.0" encoding="GB2312"?>
+<Response>
+<CmdType>Alarm</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<Result>OK</Result>
+</Response>
+`
+	// AlarmResetXML 报警复位xml样式
+	AlarmResetXML = `<?xml version="1.0" encoding="GB2312"?>
+<Control>
+<CmdType>DeviceControl</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<AlarmCmd>ResetAlarm</AlarmCmd>
+%s</Control>
+`
+	// KeepaliveXML 心跳xml样式，作为下级平台向上级发送
+	KeepaliveXML = `<?xml version="1.0" encoding="GB2312"?>
+<Notify>
+<CmdType>Keepalive</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<Status>OK</Status>
+</Notify>
+`
+	// DeviceControlPTZXML 云台控制xml样式
+	DeviceControlPTZXML = `<?xml version="1.0" encoding="GB2312"?>
+<Control>
+<CmdType>DeviceControl</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<PTZCmd>%s</PTZCmd>
+<Info>
+<ControlPriority>5</ControlPriority>
+</Info>
+</Control>
+`
+)
+
+// PTZ 指令码 GB28181 A.3.2 位5~0:镜头变倍缩小、放大，云台上、下、左、右，全0为停止
+const (
+	PTZCodeStop    byte = 0x00
+	PTZCodeRight   byte = 0x01
+	PTZCodeLeft    byte = 0x02
+	PTZCodeDown    byte = 0x04
+	PTZCodeUp      byte = 0x08
+	PTZCodeZoomIn  byte = 0x10
+	PTZCodeZoomOut byte = 0x20
+)
+
+// 预置位、巡航、扫描指令码 GB28181 A.3.4~A.3.6
+const (
+	// PTZCodeSetPreset 设置预置位，数据2为预置位号
+	PTZCodeSetPreset byte = 0x81
+	// PTZCodeCallPreset 调用预置位
+	PTZCodeCallPreset byte = 0x82
+	// PTZCodeDelPreset 删除预置位
+	PTZCodeDelPreset byte = 0x83
+	// PTZCodeAddCruise 加入巡航点，数据1为巡航组号，数据2为预置位号
+	PTZCodeAddCruise byte = 0x84
+	// PTZCodeDelCruise 删除巡航点，预置位号为0时删除整条巡航
+	PTZCodeDelCruise byte = 0x85
+	// PTZCodeCruiseSpeed 设置巡航速度，数据2、数据3为速度低8位、高4位
+	PTZCodeCruiseSpeed byte = 0x86
+	// PTZCodeCruiseDwell 设置巡航停留时间，单位秒
+	PTZCodeCruiseDwell byte = 0x87
+	// PTZCodeStartCruise 开始巡航
+	PTZCodeStartCruise byte = 0x88
+	// PTZCodeScan 自动扫描，数据2为0开始，1设置左边界，2设置右边界
+	PTZCodeScan byte = 0x89
+	// PTZCodeScanSpeed 设置自动扫描速度
+	PTZCodeScanSpeed byte = 0x8A
 )
 
+// PTZCmd 生成8字节PTZ指令，返回16进制字符串 GB28181 A.3.1
+// 字节5、6为数据1、2，data3为字节7高4位数据，地址固定为1
+func PTZCmd(code, data1, data2, data3 byte) string {
+	cmd := [8]byte{0xA5, 0x0F, 0x01, code, data1, data2, (data3 & 0x0F) << 4}
+	// 字节2 高4位为组合码1(版本0)，低4位为校验码 (0xA+0x5+0x0)%16
+	var sum int
+	for _, b := range cmd[:7] {
+		sum += int(b)
+	}
+	cmd[7] = byte(sum % 256)
+	return fmt.Sprintf("%X", cmd[:])
+}
+
 // GetDeviceInfoXML 获取设备详情指令
 func GetDeviceInfoXML(id string) []byte {
 	return []byte(fmt.Sprintf(DeviceInfoXML, utils.RandInt(100000, 999999), id))
 }
 
+// GetKeepaliveXML 获取心跳通知
+func GetKeepaliveXML(id string) []byte {
+	return []byte(fmt.Sprintf(KeepaliveXML, utils.RandInt(100000, 999999), id))
+}
+
 // GetCatalogXML 获取NVR下设备列表指令
 func GetCatalogXML(id string) []byte {
 	return []byte(fmt.Sprintf(CatalogXML, utils.RandInt(100000, 999999), id))
 }
 
+// GetPTZXML 获取云台控制指令
+func GetPTZXML(id string, cmd string) []byte {
+	return []byte(fmt.Sprintf(DeviceControlPTZXML, utils.RandInt(100000, 999999), id, cmd))
+}
+
+// GetPresetQueryXML 获取预置位查询指令
+func GetPresetQueryXML(id string, sn int) []byte {
+	return []byte(fmt.Sprintf(PresetQueryXML, sn, id))
+}
+
+// GetAlarmSubscribeXML 获取报警订阅指令
+func GetAlarmSubscribeXML(id string) []byte {
+	return []byte(fmt.Sprintf(AlarmSubscribeXML, utils.RandInt(100000, 999999), id))
+}
+
+// GetMobilePositionSubscribeXML 获取移动设备位置订阅指令，interval为上报间隔(秒)
+func GetMobilePositionSubscribeXML(id string, interval int) []byte {
+	return []byte(fmt.Sprintf(MobilePositionSubscribeXML, utils.RandInt(100000, 999999), id, interval))
+}
+
+// GetAlarmResponseXML 获取报警通知应答
+func GetAlarmResponseXML(id string, sn int) []byte {
+	return []byte(fmt.Sprintf(AlarmResponseXML, sn, id))
+}
+
+// GetAlarmResetXML 获取报警复位指令，method、alarmType为空时复位全部报警
+func GetAlarmResetXML(id, method, alarmType string) []byte {
+	info := ""
+	if method != "" || alarmType != "" {
+		info = fmt.Sprintf("<Info>\n<AlarmMethod>%s</AlarmMethod>\n<AlarmType>%s</AlarmType>\n</Info>\n", method, alarmType)
+	}
+	return []byte(fmt.Sprintf(AlarmResetXML, utils.RandInt(100000, 999999), id, info))
+}
+
 // GetRecordInfoXML 获取录像文件列表指令
 func GetRecordInfoXML(id string, sceqNo int, start, end int64) []byte {
 	return []byte(fmt.Sprintf(RecordInfoXML, sceqNo, id, time.Unix(start, 0).Format("2006-01-02T15:04:05"), time.Unix(end, 0).Format("2006-01-02T15:04:05")))
 }
 
+// GetMANSRTSPPlay 回放恢复播放或跳转，pos<0时为从暂停处恢复，否则跳转到相对回放开始的pos秒
+func GetMANSRTSPPlay(cseq uint32, pos int64) []byte {
+	if pos < 0 {
+		return []byte(fmt.Sprintf("PLAY RTSP/1.0\r\nCSeq: %d\r\nRange: npt=now-\r\n", cseq))
+	}
+	return []byte(fmt.Sprintf("PLAY RTSP/1.0\r\nCSeq: %d\r\nRange: npt=%d-\r\n", cseq, pos))
+}
+
+// GetMANSRTSPPause 回放暂停
+func GetMANSRTSPPause(cseq uint32) []byte {
+	return []byte(fmt.Sprintf("PAUSE RTSP/1.0\r\nCSeq: %d\r\nPauseTime: now\r\n", cseq))
+}
+
+// GetMANSRTSPScale 回放倍速
+func GetMANSRTSPScale(cseq uint32, scale float64) []byte {
+	value := strconv.FormatFloat(scale, 'f', -1, 64)
+	if !strings.Contains(value, ".") {
+		value += ".0"
+	}
+	return []byte(fmt.Sprintf("PLAY RTSP/1.0\r\nCSeq: %d\r\nScale: %s\r\n", cseq, value))
+}
+
 // RFC3261BranchMagicCookie RFC3261BranchMagicCookie
 const RFC3261BranchMagicCookie = "z9hG4bK"
 
@@ -614,7 +614,7 @@ func (p *parser) start() {
 				if err == nil {
 					headers = append(headers, newHeaders...)
 				} else {
-					logrus.Warnf("skip header '%s' due to error: %s", buffer, err)
+					logrus.Warnf("skip header '%s' due to error: %s", buffer.String(), err)
 				}
 				buffer.Reset()
 			}
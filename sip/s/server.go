@@ -1,10 +1,18 @@
 package sip
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/panjjo/gosip/utils"
 	"github.com/sirupsen/logrus"
@@ -14,44 +22,147 @@ var (
 	bufferSize uint16 = 65535 - 20 - 8 // IPv4 max size - IPv4 Header size - UDP Header size
 )
 
-// RequestHandler RequestHandler
+// RequestHandler 请求处理，ACK请求不属于任何事务，tx为nil
 type RequestHandler func(req *Request, tx *Transaction)
 
 // Server Server
 type Server struct {
 	udpaddr net.Addr
 	conn    Connection
+	// tcp连接 key=远端地址 value=*tcpConnection
+	tcpConns *sync.Map
+	// tls连接 key=远端地址 value=*tcpConnection
+	tlsConns  *sync.Map
+	tlsConfig *tls.Config
+	parser    *parser
 
 	txs *transacionts
+	// 已确认的INVITE对话 key=Call-ID|本端tag|远端tag，用于2xx重传时重发ACK
+	dialogs *sync.Map
 
 	hmu             *sync.RWMutex
 	requestHandlers map[RequestMethod]RequestHandler
 
-	port *Port
-	host net.IP
+	port    *Port
+	tcpPort *Port
+	tlsPort *Port
+	host    net.IP
 }
 
 // NewServer NewServer
 func NewServer() *Server {
-	activeTX = &transacionts{txs: map[string]*Transaction{}, rwm: &sync.RWMutex{}}
+	activeTX = &transacionts{txs: map[string]*Transaction{}, rwm: &sync.RWMutex{}, timers: DefaultTimers}
 	srv := &Server{hmu: &sync.RWMutex{},
 		txs:             activeTX,
+		tcpConns:        &sync.Map{},
+		tlsConns:        &sync.Map{},
+		dialogs:         &sync.Map{},
+		parser:          newParser(),
 		requestHandlers: map[RequestMethod]RequestHandler{}}
+	go srv.handlerListen(srv.parser.out)
 	return srv
 }
 
-// func (s *Server) newTX(key string) *Transaction {
-// 	return s.txs.newTX(key, s.conn)
-// }
 func (s *Server) getTX(key string) *Transaction {
 	return s.txs.getTX(key)
 }
-func (s *Server) mustTX(key string) *Transaction {
-	tx := s.txs.getTX(key)
-	if tx == nil {
-		tx = s.txs.newTX(key, s.conn)
+
+// SetTimers 设置事务定时器，未设置的使用默认值
+func (s *Server) SetTimers(timers Timers) {
+	if timers.T1 <= 0 {
+		timers.T1 = DefaultTimers.T1
+	}
+	if timers.T2 <= 0 {
+		timers.T2 = DefaultTimers.T2
+	}
+	if timers.T4 <= 0 {
+		timers.T4 = DefaultTimers.T4
+	}
+	if timers.C <= 0 {
+		timers.C = DefaultTimers.C
+	}
+	s.txs.rwm.Lock()
+	s.txs.timers = timers
+	s.txs.rwm.Unlock()
+}
+
+// getConn 根据传输协议选择连接，tcp/tls使用对端已建立的连接，不存在时主动建立
+func (s *Server) getConn(transport string, raddr net.Addr) (Connection, error) {
+	switch strings.ToUpper(transport) {
+	case "TCP":
+		if raddr == nil {
+			return nil, fmt.Errorf("missing tcp remote address")
+		}
+		if conn, ok := s.tcpConns.Load(raddr.String()); ok {
+			return conn.(Connection), nil
+		}
+		baseConn, err := net.DialTimeout("tcp", raddr.String(), 5*time.Second)
+		if err != nil {
+			return nil, utils.NewError(err, "tcp dial fail", raddr.String())
+		}
+		conn := newTCPConnection(baseConn)
+		go s.serveStreamConn(conn, s.tcpConns)
+		return conn, nil
+	case "TLS":
+		if raddr == nil {
+			return nil, fmt.Errorf("missing tls remote address")
+		}
+		if conn, ok := s.tlsConns.Load(raddr.String()); ok {
+			return conn.(Connection), nil
+		}
+		if s.tlsConfig == nil {
+			return nil, fmt.Errorf("tls server not listen")
+		}
+		config := s.tlsConfig.Clone()
+		config.RootCAs = config.ClientCAs
+		baseConn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", raddr.String(), config)
+		if err != nil {
+			return nil, utils.NewError(err, "tls dial fail", raddr.String())
+		}
+		conn := newTCPConnection(baseConn)
+		conn.logKey = "tlsConnection"
+		go s.serveStreamConn(conn, s.tlsConns)
+		return conn, nil
+	default:
+		if s.conn == nil {
+			return nil, fmt.Errorf("udp server not listen")
+		}
+		return s.conn, nil
+	}
+}
+
+// LocalURI 本端sip地址，host为本机ip，端口为传输协议对应的监听端口
+func (s *Server) LocalURI(user, transport string) (URI, error) {
+	if s.host == nil {
+		return URI{}, fmt.Errorf("server not listen")
+	}
+	return ParseSipURI(fmt.Sprintf("sip:%s@%s:%s", user, s.host, s.transportPort(transport)))
+}
+
+// transportPort 传输协议对应的本地监听端口
+func (s *Server) transportPort(transport string) *Port {
+	switch strings.ToUpper(transport) {
+	case "TCP":
+		return s.tcpPort
+	case "TLS":
+		return s.tlsPort
+	default:
+		return s.port
+	}
+}
+
+// getSourceConn 获取收到消息的连接，tcp/tls按远端地址查找已建立的连接
+func (s *Server) getSourceConn(raddr net.Addr) (Connection, error) {
+	if raddr.Network() == "tcp" {
+		if conn, ok := s.tcpConns.Load(raddr.String()); ok {
+			return conn.(Connection), nil
+		}
+		if conn, ok := s.tlsConns.Load(raddr.String()); ok {
+			return conn.(Connection), nil
+		}
+		return nil, fmt.Errorf("stream connection closed: %s", raddr)
 	}
-	return tx
+	return s.getConn("UDP", raddr)
 }
 
 // ListenUDPServer ListenUDPServer
@@ -75,16 +186,117 @@ func (s *Server) ListenUDPServer(addr string) {
 		num   int
 	)
 	buf := make([]byte, bufferSize)
-	parser := newParser()
-	defer parser.stop()
-	go s.handlerListen(parser.out)
 	for {
 		num, raddr, err = s.conn.ReadFrom(buf)
 		if err != nil {
 			logrus.Errorln("udp.ReadFromUDP err", err)
 			continue
 		}
-		parser.in <- newPacket(append([]byte{}, buf[:num]...), raddr)
+		s.parser.in <- newPacket(append([]byte{}, buf[:num]...), raddr)
+	}
+}
+
+// ListenTCPServer ListenTCPServer
+func (s *Server) ListenTCPServer(addr string) {
+	tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		logrus.Fatal("net.ResolveTCPAddr err", err, addr)
+	}
+	s.tcpPort = NewPort(tcpaddr.Port)
+	if s.host == nil {
+		s.host, err = utils.ResolveSelfIP()
+		if err != nil {
+			logrus.Fatal("net.ListenTCP resolveip err", err, addr)
+		}
+	}
+	listener, err := net.ListenTCP("tcp", tcpaddr)
+	if err != nil {
+		logrus.Fatal("net.ListenTCP err", err, addr)
+	}
+	for {
+		baseConn, err := listener.Accept()
+		if err != nil {
+			logrus.Errorln("tcp.Accept err", err)
+			continue
+		}
+		go s.serveStreamConn(newTCPConnection(baseConn), s.tcpConns)
+	}
+}
+
+// NewTLSConfig 加载服务端证书，ca不为空时要求并校验客户端证书
+func NewTLSConfig(cert, key, ca string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, utils.NewError(err, "load tls certificate fail", cert, key)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, utils.NewError(err, "load tls client ca fail", ca)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, utils.NewError(nil, "invalid tls client ca", ca)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ListenTLSServer ListenTLSServer
+func (s *Server) ListenTLSServer(addr string, config *tls.Config) {
+	tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		logrus.Fatal("net.ResolveTCPAddr err", err, addr)
+	}
+	s.tlsPort = NewPort(tcpaddr.Port)
+	s.tlsConfig = config
+	if s.host == nil {
+		s.host, err = utils.ResolveSelfIP()
+		if err != nil {
+			logrus.Fatal("tls.Listen resolveip err", err, addr)
+		}
+	}
+	listener, err := tls.Listen("tcp", tcpaddr.String(), config)
+	if err != nil {
+		logrus.Fatal("tls.Listen err", err, addr)
+	}
+	for {
+		baseConn, err := listener.Accept()
+		if err != nil {
+			logrus.Errorln("tls.Accept err", err)
+			continue
+		}
+		conn := newTCPConnection(baseConn)
+		conn.logKey = "tlsConnection"
+		go s.serveStreamConn(conn, s.tlsConns)
+	}
+}
+
+// serveStreamConn 读取tcp/tls连接上的消息，连接断开后移除
+func (s *Server) serveStreamConn(conn *tcpConnection, conns *sync.Map) {
+	key := conn.RemoteAddr().String()
+	conns.Store(key, conn)
+	logrus.Traceln("new stream connection", conn.logKey, key)
+	defer func() {
+		conns.Delete(key)
+		conn.Close()
+		logrus.Traceln("closed stream connection", conn.logKey, key)
+	}()
+	for {
+		data, err := conn.readMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logrus.Warnln("stream read message err", err)
+			}
+			return
+		}
+		s.parser.in <- newPacket(data, conn.RemoteAddr())
 	}
 }
 
@@ -113,11 +325,31 @@ func (s *Server) handlerListen(msgs chan Message) {
 	}
 }
 func (s *Server) handlerRequest(msg *Request) {
-	tx := s.mustTX(getTXKey(msg))
-	logrus.Traceln("receive request from:", msg.Source(), ",method:", msg.Method(), "txKey:", tx.key, "message: \n", msg.String())
+	key := getServerTXKey(msg)
+	if tx := s.getTX(key); tx != nil {
+		// 请求重传或者非2xx响应的ACK，由事务处理，不再调用handler
+		logrus.Traceln("receive request for exist tx from:", msg.Source(), ",method:", msg.Method(), "txKey:", key)
+		tx.receiveRequest(msg)
+		return
+	}
 	s.hmu.RLock()
 	handler, ok := s.requestHandlers[msg.Method()]
 	s.hmu.RUnlock()
+	if msg.IsAck() {
+		// 2xx的ACK不属于任何事务，不能响应
+		logrus.Traceln("receive ack from:", msg.Source(), "message: \n", msg.String())
+		if ok {
+			go handler(msg, nil)
+		}
+		return
+	}
+	conn, err := s.getSourceConn(msg.Source())
+	if err != nil {
+		logrus.Errorln("not found connection,source:", msg.Source(), err)
+		return
+	}
+	tx := s.txs.newServerTX(key, conn, msg)
+	logrus.Traceln("receive request from:", msg.Source(), ",method:", msg.Method(), "txKey:", tx.key, "message: \n", msg.String())
 	if !ok {
 		logrus.Errorln("not found handler func,requestMethod:", msg.Method(), msg.String())
 		go handlerMethodNotAllowed(msg, tx)
@@ -128,7 +360,10 @@ func (s *Server) handlerRequest(msg *Request) {
 }
 
 func (s *Server) handlerResponse(msg *Response) {
-	tx := s.getTX(getTXKey(msg))
+	tx := s.getTX(getClientTXKey(msg))
+	if tx == nil && s.ackRetransmission(msg) {
+		return
+	}
 	if tx == nil {
 		logrus.Infoln("not found tx. receive response from:", msg.Source(), "message: \n", msg.String())
 	} else {
@@ -143,8 +378,16 @@ func (s *Server) Request(req *Request) (*Transaction, error) {
 	if !ok {
 		return nil, fmt.Errorf("missing required 'Via' header")
 	}
+	if recipient := req.Recipient(); recipient != nil && recipient.FIsEncrypted {
+		// sips uri 必须使用tls发送
+		viaHop.Transport = "TLS"
+	}
+	conn, err := s.getConn(viaHop.Transport, req.Destination())
+	if err != nil {
+		return nil, err
+	}
 	viaHop.Host = s.host.String()
-	viaHop.Port = s.port
+	viaHop.Port = s.transportPort(viaHop.Transport)
 	if viaHop.Params == nil {
 		viaHop.Params = NewParams().Add("branch", String{Str: GenerateBranch()})
 	}
@@ -152,8 +395,115 @@ func (s *Server) Request(req *Request) (*Transaction, error) {
 		viaHop.Params.Add("rport", nil)
 	}
 
-	tx := s.mustTX(getTXKey(req))
-	return tx, tx.Request(req)
+	tx := s.txs.newClientTX(getClientTXKey(req), conn)
+	if err := tx.Request(req); err != nil {
+		tx.Close()
+		return tx, err
+	}
+	return tx, nil
+}
+
+// ProvisionalHandler 收到临时响应(1xx)时回调
+type ProvisionalHandler func(res *Response)
+
+// RequestContext 发送请求并等待最终响应，ctx取消或超时返回ctx.Err()
+// INVITE 请求在取消时发送CANCEL，取消后仍收到2xx时自动ACK并BYE
+func (s *Server) RequestContext(ctx context.Context, req *Request, onProvisional ProvisionalHandler) (*Response, error) {
+	if req.IsInvite() {
+		// INVITE最长等待Timer C，超时后CANCEL，事务本身的Timer C晚于此超时
+		s.txs.rwm.RLock()
+		timeout := s.txs.timers.C
+		s.txs.rwm.RUnlock()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	tx, err := s.Request(req)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case res := <-tx.resp:
+			if res == nil {
+				return nil, utils.NewError(nil, "response timeout", "tx key:", tx.Key())
+			}
+			if res.StatusCode() < http.StatusOK {
+				if onProvisional != nil {
+					onProvisional(res)
+				}
+				continue
+			}
+			return res, nil
+		case <-ctx.Done():
+			logrus.Infoln("request canceled, txkey:", tx.Key(), ctx.Err())
+			if req.IsInvite() {
+				go s.cancelInvite(tx)
+			} else {
+				tx.Close()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// cancelInvite 取消INVITE请求 RFC 3261 9.1，收到2xx时结束已建立的对话
+func (s *Server) cancelInvite(tx *Transaction) {
+	canceled := false
+	cancel := func() {
+		if canceled {
+			return
+		}
+		canceled = true
+		req := newCancelRequest(tx.origin)
+		ctx := s.txs.newClientTX(getClientTXKey(req), tx.conn)
+		if err := ctx.Request(req); err != nil {
+			logrus.Warnln("send cancel fail, txkey:", tx.Key(), err)
+		}
+	}
+	// 收到临时响应后才能发送CANCEL
+	if tx.State() == TxStateProceeding {
+		cancel()
+	}
+	for res := range tx.resp {
+		if res.StatusCode() < http.StatusOK {
+			cancel()
+			continue
+		}
+		if res.StatusCode() >= http.StatusMultipleChoices {
+			return
+		}
+		dialog, err := s.NewDialogFromResponse(res)
+		if err != nil {
+			logrus.Warnln("canceled invite dialog fail, txkey:", tx.Key(), err)
+			return
+		}
+		if err = dialog.Ack(res); err != nil {
+			logrus.Warnln("canceled invite ack fail, txkey:", tx.Key(), err)
+		}
+		if _, err = dialog.Bye(); err != nil {
+			logrus.Warnln("canceled invite bye fail, txkey:", tx.Key(), err)
+		}
+		return
+	}
+}
+
+// newCancelRequest 生成CANCEL请求，Via与原请求相同
+func newCancelRequest(req *Request) *Request {
+	cancel := NewRequest("", CANCEL, req.Recipient().Clone(), req.SipVersion(), []Header{}, []byte{})
+	if via, ok := req.Via(); ok && len(via) > 0 {
+		cancel.AppendHeader(ViaHeader{via[0].Clone()})
+	}
+	CopyHeaders("Route", req, cancel)
+	CopyHeaders("From", req, cancel)
+	CopyHeaders("To", req, cancel)
+	CopyHeaders("Call-ID", req, cancel)
+	if cseq, ok := req.CSeq(); ok {
+		cancel.AppendHeader(&CSeq{SeqNo: cseq.SeqNo, MethodName: CANCEL})
+	}
+	cancel.SetBody([]byte{}, true)
+	cancel.SetDestination(req.Destination())
+	return cancel
 }
 
 func handlerMethodNotAllowed(req *Request, tx *Transaction) {
@@ -2,6 +2,8 @@ package sip
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,12 +14,47 @@ import (
 var activeTX *transacionts
 
 type transacionts struct {
-	txs map[string]*Transaction
-	rwm *sync.RWMutex
+	txs    map[string]*Transaction
+	rwm    *sync.RWMutex
+	timers Timers
 }
 
-func (txs *transacionts) newTX(key string, conn Connection) *Transaction {
-	tx := NewTransaction(key, conn)
+// newServerTX 新建服务端事务，缓存最后的响应用来应答请求重传
+func (txs *transacionts) newServerTX(key string, conn Connection, req *Request) *Transaction {
+	tx := &Transaction{
+		conn:   conn,
+		key:    key,
+		timers: txs.timers,
+		origin: req,
+		reqIn:  make(chan *Request, 10),
+		final:  make(chan *Response, 1),
+		done:   make(chan struct{}),
+	}
+	if req.IsInvite() {
+		tx.state = TxStateProceeding
+	} else {
+		tx.state = TxStateTrying
+	}
+	logrus.Traceln("new server tx", key, time.Now().Format("2006-01-02 15:04:05"))
+	txs.rwm.Lock()
+	txs.txs[key] = tx
+	txs.rwm.Unlock()
+	go tx.runServer()
+	return tx
+}
+
+// newClientTX 新建客户端事务，发送请求后由状态机负责重传和超时
+func (txs *transacionts) newClientTX(key string, conn Connection) *Transaction {
+	tx := &Transaction{
+		conn:   conn,
+		key:    key,
+		resp:   make(chan *Response, 10),
+		client: true,
+		timers: txs.timers,
+		in:     make(chan *Response, 10),
+		done:   make(chan struct{}),
+	}
+	logrus.Traceln("new client tx", key, time.Now().Format("2006-01-02 15:04:05"))
 	txs.rwm.Lock()
 	txs.txs[key] = tx
 	txs.rwm.Unlock()
@@ -36,24 +73,85 @@ func (txs *transacionts) getTX(key string) *Transaction {
 
 func (txs *transacionts) rmTX(tx *Transaction) {
 	txs.rwm.Lock()
-	delete(txs.txs, tx.key)
+	if txs.txs[tx.key] == tx {
+		delete(txs.txs, tx.key)
+	}
 	txs.rwm.Unlock()
 }
 
+// Timers 事务定时器 RFC 3261 17.1.1.1
+type Timers struct {
+	// T1 RTT估计值，重传初始间隔
+	T1 time.Duration
+	// T2 非INVITE请求和INVITE响应的最大重传间隔
+	T2 time.Duration
+	// T4 消息在网络中的最大存留时间
+	T4 time.Duration
+	// C INVITE收到临时响应后等待最终响应的最长时间 RFC 3261 16.6
+	C time.Duration
+}
+
+// DefaultTimers RFC 3261 推荐值
+var DefaultTimers = Timers{T1: 500 * time.Millisecond, T2: 4 * time.Second, T4: 5 * time.Second, C: 3 * time.Minute}
+
+// TransactionState 事务状态 RFC 3261 17.1
+type TransactionState int
+
+const (
+	// TxStateCalling INVITE客户端事务已发送请求
+	TxStateCalling TransactionState = iota
+	// TxStateTrying 非INVITE客户端事务已发送请求
+	TxStateTrying
+	// TxStateProceeding 收到临时响应
+	TxStateProceeding
+	// TxStateCompleted 收到(服务端为发送)最终响应，等待吸收重传
+	TxStateCompleted
+	// TxStateConfirmed INVITE服务端事务收到非2xx最终响应的ACK
+	TxStateConfirmed
+	// TxStateAccepted INVITE服务端事务已发送2xx，吸收INVITE重传 RFC 6026
+	TxStateAccepted
+	// TxStateTerminated 事务结束
+	TxStateTerminated
+)
+
+var txStateNames = map[TransactionState]string{
+	TxStateCalling:    "Calling",
+	TxStateTrying:     "Trying",
+	TxStateProceeding: "Proceeding",
+	TxStateCompleted:  "Completed",
+	TxStateConfirmed:  "Confirmed",
+	TxStateAccepted:   "Accepted",
+	TxStateTerminated: "Terminated",
+}
+
+func (state TransactionState) String() string {
+	return txStateNames[state]
+}
+
 // Transaction Transaction
 type Transaction struct {
-	conn   Connection
-	key    string
-	resp   chan *Response
-	active chan int
-}
+	conn Connection
+	key  string
+	// client 是否客户端事务
+	client bool
+	timers Timers
+	// origin 创建事务的请求
+	origin *Request
+	state  TransactionState
+	mu     sync.Mutex
+	done   chan struct{}
+	once   sync.Once
+	// running 客户端状态机已启动，resp 只由状态机关闭
+	running bool
 
-// NewTransaction NewTransaction
-func NewTransaction(key string, conn Connection) *Transaction {
-	logrus.Traceln("new tx", key, time.Now().Format("2006-01-02 15:04:05"))
-	tx := &Transaction{conn: conn, key: key, resp: make(chan *Response, 10), active: make(chan int, 1)}
-	go tx.watch()
-	return tx
+	// 客户端事务
+	resp chan *Response
+	in   chan *Response
+
+	// 服务端事务
+	last  *Response
+	reqIn chan *Request
+	final chan *Response
 }
 
 // Key Key
@@ -61,30 +159,33 @@ func (tx *Transaction) Key() string {
 	return tx.key
 }
 
-func (tx *Transaction) watch() {
-	for {
-		select {
-		case <-tx.active:
-			logrus.Traceln("active tx", tx.Key(), time.Now().Format("2006-01-02 15:04:05"))
-		case <-time.After(20 * time.Second):
-			tx.Close()
-			logrus.Traceln("watch closed tx", tx.key, time.Now().Format("2006-01-02 15:04:05"))
-			return
-		}
-	}
+// State 当前事务状态
+func (tx *Transaction) State() TransactionState {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.state
+}
+
+func (tx *Transaction) setState(state TransactionState) {
+	tx.mu.Lock()
+	logrus.Traceln("tx state", tx.key, tx.state, "->", state)
+	tx.state = state
+	tx.mu.Unlock()
 }
 
-// GetResponse GetResponse
+// GetResponse 等待最终响应，事务超时或结束返回nil
 func (tx *Transaction) GetResponse() *Response {
+	if !tx.client {
+		return nil
+	}
 	for {
 		res := <-tx.resp
 		if res == nil {
 			return res
 		}
-		tx.active <- 2
 		logrus.Traceln("response tx", tx.key, time.Now().Format("2006-01-02 15:04:05"))
-		if res.StatusCode() == http.StatusContinue || res.statusCode == http.StatusSwitchingProtocols {
-			// Trying and Dialog Establishement 等待下一个返回
+		if res.StatusCode() < http.StatusOK {
+			// 临时响应 Trying,Ringing 等待下一个返回
 			continue
 		}
 		return res
@@ -93,36 +194,319 @@ func (tx *Transaction) GetResponse() *Response {
 
 // Close Close
 func (tx *Transaction) Close() {
-	logrus.Traceln("closed tx", tx.key, time.Now().Format("2006-01-02 15:04:05"))
-	activeTX.rmTX(tx)
-	close(tx.resp)
-	close(tx.active)
+	tx.terminate()
+}
+
+// terminate 事务结束，客户端事务通知等待方
+// 可能在其他协程调用，状态机运行时由状态机退出时关闭resp，避免向已关闭的resp发送响应
+func (tx *Transaction) terminate() {
+	tx.once.Do(func() {
+		tx.mu.Lock()
+		logrus.Traceln("tx state", tx.key, tx.state, "->", TxStateTerminated)
+		tx.state = TxStateTerminated
+		running := tx.running
+		tx.mu.Unlock()
+		logrus.Traceln("terminated tx", tx.key, time.Now().Format("2006-01-02 15:04:05"))
+		activeTX.rmTX(tx)
+		close(tx.done)
+		if tx.client && !running {
+			close(tx.resp)
+		}
+	})
 }
 
 // Response Response
 func (tx *Transaction) receiveResponse(msg *Response) {
-	defer func() {
-		if r := recover(); r != nil {
-			logrus.Errorln("send to closed channel, txkey:", tx.key, "message: \n", msg.String())
-		}
-	}()
-	logrus.Traceln("receiveResponse tx", tx.Key(), time.Now().Format("2006-01-02 15:04:05"))
-	tx.resp <- msg
-	tx.active <- 1
+	if !tx.client {
+		return
+	}
+	select {
+	case tx.in <- msg:
+	case <-tx.done:
+		logrus.Traceln("receive response after tx terminated, txkey:", tx.key)
+	}
 }
 
-// Respond Respond
+// receiveRequest 服务端事务收到重传的请求或ACK
+func (tx *Transaction) receiveRequest(req *Request) {
+	select {
+	case tx.reqIn <- req:
+	case <-tx.done:
+		logrus.Traceln("receive request after tx terminated, txkey:", tx.key)
+	}
+}
+
+// Respond 发送响应，服务端事务记录最后的响应，最终响应后进入完成状态
 func (tx *Transaction) Respond(res *Response) error {
 	logrus.Traceln("send response,to:", res.dest.String(), "txkey:", tx.key, "message: \n", res.String())
 	_, err := tx.conn.WriteTo([]byte(res.String()), res.dest)
+	if tx.client || tx.origin == nil {
+		return err
+	}
+	tx.mu.Lock()
+	tx.last = res
+	tx.mu.Unlock()
+	if res.StatusCode() >= http.StatusOK {
+		select {
+		case tx.final <- res:
+		default:
+		}
+	}
 	return err
 }
 
-// Request Request
+func (tx *Transaction) lastResponse() *Response {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.last
+}
+
+func (tx *Transaction) write(res *Response) {
+	if _, err := tx.conn.WriteTo([]byte(res.String()), res.dest); err != nil {
+		logrus.Warnln("retransmit response fail, txkey:", tx.key, err)
+	}
+}
+
+// runServer 服务端事务状态机 RFC 3261 17.2.1 INVITE, 17.2.2 非INVITE
+func (tx *Transaction) runServer() {
+	invite := tx.origin.IsInvite()
+	interval := tx.timers.T1
+	// Timer G 非2xx最终响应重传，收到ACK后停止
+	var retransmit *time.Timer
+	var retransmitC <-chan time.Time
+	defer func() {
+		if retransmit != nil {
+			retransmit.Stop()
+		}
+	}()
+	// 使用方长时间不响应时结束事务
+	idle := time.NewTimer(64 * tx.timers.T1)
+	defer idle.Stop()
+	// Timer H/I/J 等待结束
+	var wait <-chan time.Time
+	wait64T1 := 64 * tx.timers.T1
+	if tx.reliable() {
+		wait64T1 = 0
+	}
+
+	for {
+		select {
+		case req := <-tx.reqIn:
+			state := tx.State()
+			if req.IsAck() {
+				if invite && state == TxStateCompleted {
+					tx.setState(TxStateConfirmed)
+					retransmitC = nil
+					if tx.reliable() {
+						wait = time.After(0)
+					} else {
+						wait = time.After(tx.timers.T4)
+					}
+				}
+				continue
+			}
+			// 请求重传，回复最后一次响应
+			logrus.Traceln("absorb request retransmission, txkey:", tx.key, "state:", state)
+			if last := tx.lastResponse(); last != nil {
+				tx.write(last)
+			} else if invite {
+				tx.write(NewResponseFromRequest("", tx.origin, http.StatusContinue, "Trying", nil))
+			}
+		case res := <-tx.final:
+			idle.Stop()
+			switch {
+			case invite && res.StatusCode() < http.StatusMultipleChoices:
+				tx.setState(TxStateAccepted)
+				wait = time.After(64 * tx.timers.T1)
+			case invite:
+				tx.setState(TxStateCompleted)
+				if !tx.reliable() {
+					retransmit = time.NewTimer(interval)
+					retransmitC = retransmit.C
+				}
+				wait = time.After(64 * tx.timers.T1)
+			default:
+				tx.setState(TxStateCompleted)
+				wait = time.After(wait64T1)
+			}
+		case <-retransmitC:
+			if last := tx.lastResponse(); last != nil {
+				tx.write(last)
+			}
+			interval *= 2
+			if interval > tx.timers.T2 {
+				interval = tx.timers.T2
+			}
+			retransmit.Reset(interval)
+		case <-idle.C:
+			logrus.Warnln("server tx no final response, txkey:", tx.key)
+			tx.terminate()
+			return
+		case <-wait:
+			tx.terminate()
+			return
+		case <-tx.done:
+			return
+		}
+	}
+}
+
+// Request 发送请求，客户端事务首个请求启动状态机，ACK不创建事务直接发送
 func (tx *Transaction) Request(req *Request) error {
 	logrus.Traceln("send request,to:", req.dest.String(), "txkey:", tx.key, "message: \n", req.String())
 	_, err := tx.conn.WriteTo([]byte(req.String()), req.dest)
-	return err
+	if err != nil || !tx.client || req.IsAck() || tx.origin != nil {
+		return err
+	}
+	tx.mu.Lock()
+	if tx.state == TxStateTerminated {
+		// 发送前事务已关闭
+		tx.mu.Unlock()
+		return nil
+	}
+	tx.origin = req
+	if req.IsInvite() {
+		tx.state = TxStateCalling
+	} else {
+		tx.state = TxStateTrying
+	}
+	tx.running = true
+	tx.mu.Unlock()
+	go tx.runClient()
+	return nil
+}
+
+// reliable tcp/tls 为可靠传输，不需要重传
+func (tx *Transaction) reliable() bool {
+	return tx.conn.Network() != "UDP"
+}
+
+func (tx *Transaction) resend() {
+	logrus.Traceln("retransmit request,to:", tx.origin.dest.String(), "txkey:", tx.key)
+	if _, err := tx.conn.WriteTo([]byte(tx.origin.String()), tx.origin.dest); err != nil {
+		logrus.Warnln("retransmit request fail, txkey:", tx.key, err)
+	}
+}
+
+// deliver 将响应交给事务使用方，使用方不再读取时丢弃，只在状态机协程调用
+func (tx *Transaction) deliver(res *Response) {
+	select {
+	case tx.resp <- res:
+	default:
+		logrus.Warnln("tx response buffer full, drop response, txkey:", tx.key, res.StatusCode())
+	}
+}
+
+// runClient 客户端事务状态机 RFC 3261 17.1.1 INVITE, 17.1.2 非INVITE
+func (tx *Transaction) runClient() {
+	defer close(tx.resp)
+	invite := tx.origin.IsInvite()
+	interval := tx.timers.T1
+	// Timer A/E 重传
+	retransmit := time.NewTimer(interval)
+	if tx.reliable() {
+		retransmit.Stop()
+	}
+	defer retransmit.Stop()
+	// Timer B/F 事务超时
+	timeout := time.NewTimer(64 * tx.timers.T1)
+	defer timeout.Stop()
+	// Timer D/K 完成状态等待响应重传
+	var wait <-chan time.Time
+
+	for {
+		select {
+		case <-retransmit.C:
+			state := tx.State()
+			if state == TxStateCompleted || (invite && state != TxStateCalling) {
+				continue
+			}
+			tx.resend()
+			if invite {
+				interval *= 2
+			} else if state == TxStateProceeding || interval*2 > tx.timers.T2 {
+				interval = tx.timers.T2
+			} else {
+				interval *= 2
+			}
+			retransmit.Reset(interval)
+		case res := <-tx.in:
+			state := tx.State()
+			if res.StatusCode() < 200 {
+				if state == TxStateCalling || state == TxStateTrying || state == TxStateProceeding {
+					// INVITE进入Proceeding后Timer B替换为Timer C，每个临时响应重置 RFC 3261 17.1.1.2 16.6
+					if invite {
+						if !timeout.Stop() {
+							select {
+							case <-timeout.C:
+							default:
+							}
+						}
+						timeout.Reset(tx.timers.C)
+					}
+					tx.setState(TxStateProceeding)
+					tx.deliver(res)
+				}
+				continue
+			}
+			if state == TxStateCompleted {
+				// 最终响应重传
+				if invite {
+					tx.ack(res)
+				}
+				continue
+			}
+			tx.deliver(res)
+			if invite && res.StatusCode() < 300 {
+				// 2xx 的ACK由使用方发送
+				tx.terminate()
+				return
+			}
+			if invite {
+				tx.ack(res)
+			}
+			tx.setState(TxStateCompleted)
+			timeout.Stop()
+			d := tx.timers.T4
+			if invite {
+				d = 64 * tx.timers.T1
+			}
+			if tx.reliable() {
+				d = 0
+			}
+			wait = time.After(d)
+		case <-timeout.C:
+			logrus.Warnln("client tx timeout, txkey:", tx.key)
+			tx.terminate()
+			return
+		case <-wait:
+			tx.terminate()
+			return
+		case <-tx.done:
+			return
+		}
+	}
+}
+
+// ack 非2xx最终响应由事务发送ACK RFC 3261 17.1.1.3
+func (tx *Transaction) ack(res *Response) {
+	ack := NewRequest("", ACK, tx.origin.Recipient(), tx.origin.SipVersion(), []Header{}, []byte{})
+	if via, ok := tx.origin.Via(); ok && len(via) > 0 {
+		ack.AppendHeader(ViaHeader{via[0].Clone()})
+	}
+	CopyHeaders("Route", tx.origin, ack)
+	CopyHeaders("From", tx.origin, ack)
+	CopyHeaders("To", res, ack)
+	CopyHeaders("Call-ID", tx.origin, ack)
+	if cseq, ok := tx.origin.CSeq(); ok {
+		ack.AppendHeader(&CSeq{SeqNo: cseq.SeqNo, MethodName: ACK})
+	}
+	ack.SetBody([]byte{}, true)
+	ack.SetDestination(tx.origin.Destination())
+	logrus.Traceln("send ack,to:", ack.dest.String(), "txkey:", tx.key)
+	if _, err := tx.conn.WriteTo([]byte(ack.String()), ack.dest); err != nil {
+		logrus.Warnln("send ack fail, txkey:", tx.key, err)
+	}
 }
 
 func getTXKey(msg Message) (key string) {
@@ -134,3 +518,40 @@ func getTXKey(msg Message) (key string) {
 	}
 	return
 }
+
+// getServerTXKey 服务端事务通过顶部Via的branch,sent-by和方法匹配请求重传，ACK匹配INVITE事务 RFC 3261 17.2.3
+func getServerTXKey(req *Request) string {
+	method := req.Method()
+	if method == ACK {
+		method = INVITE
+	}
+	viaHop, ok := req.ViaHop()
+	if ok {
+		if branch, ok := viaHop.Params.Get("branch"); ok && branch != nil && strings.HasPrefix(branch.String(), RFC3261BranchMagicCookie) {
+			return branch.String() + "|" + viaHop.SentBy() + "|" + string(method)
+		}
+	}
+	// 不符合RFC 3261的branch，使用Call-ID和CSeq匹配
+	key := getTXKey(req)
+	if cseq, ok := req.CSeq(); ok {
+		key += "|" + strconv.FormatUint(uint64(cseq.SeqNo), 10)
+	}
+	return key + "|" + string(method)
+}
+
+// getClientTXKey 客户端事务通过顶部Via的branch和CSeq方法匹配响应 RFC 3261 17.1.3
+func getClientTXKey(msg Message) string {
+	viaHop, ok := msg.ViaHop()
+	if !ok {
+		return getTXKey(msg)
+	}
+	branch, ok := viaHop.Params.Get("branch")
+	if !ok || branch == nil {
+		return getTXKey(msg)
+	}
+	cseq, ok := msg.CSeq()
+	if !ok {
+		return getTXKey(msg)
+	}
+	return branch.String() + "|" + string(cseq.MethodName)
+}
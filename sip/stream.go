@@ -14,7 +14,7 @@ import (
 // Streams Streams
 type Streams struct {
 	db.DBModel
-	// 0  直播 1 历史
+	// 0  直播 1 历史 2 下载
 	T int `json:"t" gorm:"column:t"`
 	// 设备ID
 	DeviceID string `json:"deviceid" gorm:"column:deviceid"`
@@ -46,12 +46,69 @@ type Streams struct {
 	WSFLV string `json:"wsflv" gorm:"column:wsflv"`
 	// zlm是否收到流
 	Stream bool `json:"stream" gorm:"column:stream"`
+	// 回放进度，相对回放开始时间的秒数，记录于PosAt
+	Position int64 `json:"position" gorm:"column:position"`
+	// 回放进度记录时间
+	PosAt int64 `json:"posat" gorm:"column:posat"`
+	// 回放倍速，下载时为下载倍速
+	Scale float64 `json:"scale" gorm:"column:scale"`
+	// 回放是否暂停
+	Paused bool `json:"paused" gorm:"column:paused"`
+	// 回放控制MANSRTSP CSeq
+	RtspSeq uint32 `json:"-" gorm:"column:rtspseq"`
+	// 回放或下载的媒体文件是否发送完成
+	Finished bool `json:"finished" gorm:"column:finished"`
+	// 下载录制文件id，对应Files.FID
+	FileID string `json:"fileid" gorm:"column:fileid"`
 
 	// ---
-	S, E time.Time     `json:"-" gorm:"-"`
-	ssrc string        // 国标ssrc 10进制字符串
-	Ext  int64         `json:"-" gorm:"-"` // 流等待过期时间
-	Resp *sip.Response `json:"-" gorm:"-"`
+	S, E   time.Time   `json:"-" gorm:"-"`
+	ssrc   string      // 国标ssrc 10进制字符串
+	Ext    int64       `json:"-" gorm:"-"` // 流等待过期时间
+	dialog *sip.Dialog // INVITE建立的对话，用来发送BYE等对话内请求
+	// 回放控制接口与媒体通知并发修改回放进度、倍速、完成状态
+	l sync.Mutex
+}
+
+// setDialog 记录对话，同时保存callid，tag等信息到数据库字段，重启后用来恢复对话
+func (s *Streams) setDialog(dialog *sip.Dialog) {
+	s.dialog = dialog
+	s.CallID = string(dialog.CallID)
+	s.CseqNo = dialog.LocalSeq
+	s.Ftag = db.M{}
+	s.Ttag = db.M{}
+	for k, v := range dialog.Local.Params.Items() {
+		s.Ftag[k] = v.String()
+	}
+	for k, v := range dialog.Remote.Params.Items() {
+		s.Ttag[k] = v.String()
+	}
+}
+
+// getDialog 获取流对应的对话，内存中不存在时通过保存的callid和tag恢复
+func (s *Streams) getDialog(device Devices) *sip.Dialog {
+	if s.dialog != nil {
+		return s.dialog
+	}
+	channelURIStr := fmt.Sprintf("sip:%s@%s", s.ChannelID, _serverDevices.Region)
+	channel := Channels{ChannelID: s.ChannelID}
+	if err := db.Get(db.DBClient, &channel); err == nil {
+		channelURIStr = channel.URIStr
+	} else {
+		logrus.Warnln("stream dialog channel not found", s.StreamID, s.ChannelID, err)
+	}
+	channelURI, _ := sip.ParseURI(channelURIStr)
+	remote := &sip.Address{URI: channelURI, Params: sip.NewParams()}
+	for k, v := range s.Ttag {
+		remote.Params.Add(k, sip.String{Str: fmt.Sprint(v)})
+	}
+	local := _serverDevices.addr.Clone()
+	local.Params = sip.NewParams()
+	for k, v := range s.Ftag {
+		local.Params.Add(k, sip.String{Str: fmt.Sprint(v)})
+	}
+	s.dialog = srv.NewDialog(sip.CallID(s.CallID), local, remote, channelURI, s.CseqNo, device.TransPort, device.source)
+	return s.dialog
 }
 
 // 当前系统中存在的流列表
@@ -92,7 +149,8 @@ func CheckStreams() {
 	for {
 		streams := []Streams{}
 		db.FindT(db.DBClient, new(Streams), &streams, db.M{"status=?": 0, "streamtype=?": "push"}, "", skip, 100, false)
-		for _, stream := range streams {
+		for i := range streams {
+			stream := &streams[i]
 			logrus.Debugln("checkStreamStreamID", stream.StreamID, stream.DeviceID)
 			if p, ok := StreamList.Response.Load(stream.StreamID); ok {
 				streamActive := p.(*Streams)
@@ -120,41 +178,18 @@ func CheckStreams() {
 				continue
 			}
 			logrus.Debugln("checkStreamClosed", stream.StreamID, stream.DeviceID)
-			// 关闭此流
-			channel := Channels{ChannelID: stream.ChannelID}
-			if err := db.Get(db.DBClient, &channel); err != nil {
-				logrus.Errorln("checkStreamGetchannelError", stream.StreamID, stream.ChannelID, err)
-				stream.Msg = err.Error()
-				db.Save(db.DBClient, stream)
-				channel = Channels{
-					ChannelID: stream.ChannelID,
-					DeviceID:  stream.DeviceID,
-					URIStr:    fmt.Sprintf("sip:%s@%s", stream.ChannelID, _serverDevices.Region),
-				}
-			}
-			channelURI, _ := sip.ParseURI(channel.URIStr)
-			channel.addr = &sip.Address{URI: channelURI, Params: sip.NewParams()}
-			for k, v := range stream.Ttag {
-				channel.addr.Params.Add(k, sip.String{Str: v.(string)})
+			// 关闭此流，内存中存在时使用已建立的对话
+			if p, ok := StreamList.Response.Load(stream.StreamID); ok && p.(*Streams).ChannelID == stream.ChannelID {
+				stream.dialog = p.(*Streams).dialog
 			}
-			for k, v := range stream.Ftag {
-				_serverDevices.addr.Params.Add(k, sip.String{Str: v.(string)})
-			}
-			callid := sip.CallID(stream.CallID)
-			stream.CseqNo++
-
-			hb := sip.NewHeaderBuilder().SetToWithParam(channel.addr).SetFrom(_serverDevices.addr).AddVia(&sip.ViaHop{
-				Params: sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
-			}).SetContentType(&sip.ContentTypeSDP).SetMethod(sip.BYE).SetContact(_serverDevices.addr).SetCallID(&callid).SetSeqNo(uint(stream.CseqNo))
-			req := sip.NewRequest("", sip.BYE, channel.addr.URI, sip.DefaultSipVersion, hb.Build(), nil)
-			req.SetDestination(device.source)
-			req.SetRecipient(channel.addr.URI)
+			dialog := stream.getDialog(device)
 
 			// 不管成功不成功 程序都删除掉，后面开新流，关闭不成功的后面重试
 			StreamList.Response.Delete(stream.StreamID)
 			StreamList.Succ.Delete(stream.ChannelID)
 
-			tx, err := srv.Request(req)
+			tx, err := dialog.Bye()
+			stream.CseqNo = dialog.LocalSeq
 			if err != nil {
 				logrus.Warningln("checkStreamClosedFail", stream.StreamID, err)
 				stream.Msg = err.Error()
@@ -163,7 +198,7 @@ func CheckStreams() {
 			}
 			response := tx.GetResponse()
 			if response == nil {
-				logrus.Warningln("checkStreamClosedFail response is nil", channel.ChannelID, channel.DeviceID, stream.StreamID)
+				logrus.Warningln("checkStreamClosedFail response is nil", stream.ChannelID, stream.DeviceID, stream.StreamID)
 				continue
 			}
 			if response.StatusCode() != http.StatusOK {
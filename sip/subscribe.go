@@ -0,0 +1,250 @@
+package sipapi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	sip "github.com/panjjo/gosip/sip/s"
+	"github.com/panjjo/gosip/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// 订阅事件
+const (
+	// SubscribeEventCatalog 目录订阅
+	SubscribeEventCatalog = "Catalog"
+	// SubscribeEventAlarm 报警订阅
+	SubscribeEventAlarm = "Alarm"
+	// SubscribeEventMobilePosition 移动设备位置订阅
+	SubscribeEventMobilePosition = "MobilePosition"
+)
+
+// subscription 设备订阅，SUBSCRIBE 成功后建立对话，过期前通过对话内SUBSCRIBE刷新
+type subscription struct {
+	deviceID string
+	event    string
+	expires  int
+	// body 订阅请求内容，每次刷新重新生成SN
+	body   func() []byte
+	dialog *sip.Dialog
+	timer  *time.Timer
+	l      sync.Mutex
+}
+
+// 当前设备订阅 key=deviceid+event
+var _subscriptions *sync.Map
+
+// subscribeRetryInterval 订阅失败后的重试间隔，设备重新注册时立即重试
+const subscribeRetryInterval = 10 * time.Minute
+
+// 订阅失败后允许重试的时间 key=deviceid+event value=time.Time
+var _subscribeRetry = &sync.Map{}
+
+// 正在同步订阅的设备，避免连续心跳重复订阅 key=deviceid
+var _subscribeSyncing = &sync.Map{}
+
+// subscribeRetryAllowed 订阅失败后是否已到重试时间
+func subscribeRetryAllowed(deviceID, event string) bool {
+	if v, ok := _subscribeRetry.Load(subscriptionKey(deviceID, event)); ok {
+		return time.Now().After(v.(time.Time))
+	}
+	return true
+}
+
+// clearSubscribeRetry 设备重新注册，清除订阅失败记录
+func clearSubscribeRetry(deviceID string) {
+	_subscribeRetry.Range(func(key, value any) bool {
+		if strings.HasPrefix(key.(string), deviceID+":") {
+			_subscribeRetry.Delete(key)
+		}
+		return true
+	})
+}
+
+func subscriptionKey(deviceID, event string) string {
+	return fmt.Sprintf("%s:%s", deviceID, event)
+}
+
+// getSubscription 获取设备订阅
+func getSubscription(deviceID, event string) (*subscription, bool) {
+	if v, ok := _subscriptions.Load(subscriptionKey(deviceID, event)); ok {
+		return v.(*subscription), true
+	}
+	return nil, false
+}
+
+// removeSubscription 删除设备订阅，停止刷新
+func removeSubscription(deviceID, event string) {
+	if v, ok := _subscriptions.LoadAndDelete(subscriptionKey(deviceID, event)); ok {
+		sub := v.(*subscription)
+		sub.l.Lock()
+		if sub.timer != nil {
+			sub.timer.Stop()
+		}
+		sub.l.Unlock()
+	}
+}
+
+// removeSubscriptions 删除设备全部订阅
+func removeSubscriptions(deviceID string) {
+	_subscriptions.Range(func(key, value any) bool {
+		sub := value.(*subscription)
+		if sub.deviceID == deviceID {
+			removeSubscription(sub.deviceID, sub.event)
+		}
+		return true
+	})
+}
+
+// sipSubscribe 向设备发送订阅，成功后在过期前自动刷新
+func sipSubscribe(device Devices, event string, expires int, body func() []byte) error {
+	removeSubscription(device.DeviceID, event)
+	local := _serverDevices.addr.Clone()
+	local.Params = sip.NewParams().Add("tag", sip.String{Str: utils.RandString(32)})
+	hb := sip.NewHeaderBuilder().SetTo(device.addr).SetFrom(local).AddVia(&sip.ViaHop{
+		Transport: device.TransPort,
+		Params:    sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+	}).SetContentType(&sip.ContentTypeXML).SetMethod(sip.SUBSCRIBE).SetContact(local)
+	req := sip.NewRequest("", sip.SUBSCRIBE, device.addr.URI, sip.DefaultSipVersion, hb.Build(), body())
+	req.SetDestination(device.source)
+	appendSubscribeHeaders(req, event, expires)
+	response, err := sipRequest(context.Background(), req)
+	if err != nil {
+		logrus.Warnln("sipSubscribe fail.id:", device.DeviceID, event, "err:", err)
+		return err
+	}
+	dialog, err := srv.NewDialogFromResponse(response)
+	if err != nil {
+		logrus.Warnln("sipSubscribe dialog fail.id:", device.DeviceID, event, "err:", err)
+		return err
+	}
+	sub := &subscription{deviceID: device.DeviceID, event: event, expires: responseExpires(response, expires), body: body, dialog: dialog}
+	_subscriptions.Store(subscriptionKey(device.DeviceID, event), sub)
+	sub.schedule()
+	logrus.Infoln("sipSubscribe succ.id:", device.DeviceID, event, "expires:", sub.expires)
+	return nil
+}
+
+// schedule 在订阅过期前刷新
+func (sub *subscription) schedule() {
+	d := time.Duration(sub.expires) * time.Second
+	// 提前10%刷新，最少提前5秒
+	ahead := d / 10
+	if ahead < 5*time.Second {
+		ahead = 5 * time.Second
+	}
+	if d > ahead {
+		d -= ahead
+	}
+	sub.l.Lock()
+	sub.timer = time.AfterFunc(d, sub.refresh)
+	sub.l.Unlock()
+}
+
+// refresh 对话内刷新订阅，失败时删除订阅，由下次心跳重新订阅
+func (sub *subscription) refresh() {
+	if cur, ok := getSubscription(sub.deviceID, sub.event); !ok || cur != sub {
+		// 订阅已删除或已重新订阅
+		return
+	}
+	req := sub.dialog.NewRequest(sip.SUBSCRIBE, &sip.ContentTypeXML, sub.body())
+	appendSubscribeHeaders(req, sub.event, sub.expires)
+	response, err := sipRequest(context.Background(), req)
+	if err != nil {
+		logrus.Warnln("subscription refresh fail.id:", sub.deviceID, sub.event, "err:", err)
+		removeSubscription(sub.deviceID, sub.event)
+		return
+	}
+	sub.expires = responseExpires(response, sub.expires)
+	sub.schedule()
+}
+
+func appendSubscribeHeaders(req *sip.Request, event string, expires int) {
+	req.AppendHeader(&sip.GenericHeader{HeaderName: "Event", Contents: event})
+	e := sip.Expires(expires)
+	req.AppendHeader(&e)
+}
+
+// responseExpires 订阅响应中的有效期，设备可能缩短有效期
+func responseExpires(response *sip.Response, def int) int {
+	if hdrs := response.GetHeaders("Expires"); len(hdrs) > 0 {
+		if e, ok := hdrs[0].(*sip.Expires); ok && *e > 0 {
+			return int(*e)
+		}
+	}
+	return def
+}
+
+// handlerNotify 订阅通知，Subscription-State为terminated时删除订阅，内容与MESSAGE相同处理
+func handlerNotify(req *sip.Request, tx *sip.Transaction) {
+	if hdrs := req.GetHeaders("Subscription-State"); len(hdrs) > 0 {
+		if state, ok := hdrs[0].(*sip.GenericHeader); ok && strings.HasPrefix(strings.ToLower(strings.TrimSpace(state.Contents)), "terminated") {
+			if u, ok := parserDevicesFromReqeust(req); ok {
+				event := ""
+				if hdrs := req.GetHeaders("Event"); len(hdrs) > 0 {
+					if h, ok := hdrs[0].(*sip.GenericHeader); ok {
+						event = strings.TrimSpace(strings.Split(h.Contents, ";")[0])
+					}
+				}
+				logrus.Infoln("subscription terminated.id:", u.DeviceID, event)
+				removeSubscription(u.DeviceID, event)
+			}
+		}
+	}
+	handlerMessage(req, tx)
+}
+
+// syncSubscriptions 心跳后检查设备订阅，不存在时重新订阅，同一设备同时只有一个同步
+func syncSubscriptions(u Devices) {
+	if _, loaded := _subscribeSyncing.LoadOrStore(u.DeviceID, true); loaded {
+		return
+	}
+	defer _subscribeSyncing.Delete(u.DeviceID)
+	syncCatalog(u)
+	if config.Subscribe.Alarm > 0 {
+		ensureSubscription(u, SubscribeEventAlarm, config.Subscribe.Alarm, func() []byte {
+			return sip.GetAlarmSubscribeXML(u.DeviceID)
+		})
+	}
+	if config.Subscribe.MobilePosition > 0 {
+		ensureSubscription(u, SubscribeEventMobilePosition, config.Subscribe.MobilePosition, func() []byte {
+			return sip.GetMobilePositionSubscribeXML(u.DeviceID, config.Subscribe.Interval)
+		})
+	}
+}
+
+// ensureSubscription 不存在订阅时发送订阅，失败后间隔一段时间或设备重新注册后再重试，返回是否新建了订阅
+func ensureSubscription(u Devices, event string, expires int, body func() []byte) bool {
+	if _, ok := getSubscription(u.DeviceID, event); ok {
+		return false
+	}
+	if !subscribeRetryAllowed(u.DeviceID, event) {
+		return false
+	}
+	if err := sipSubscribe(u, event, expires, body); err != nil {
+		_subscribeRetry.Store(subscriptionKey(u.DeviceID, event), time.Now().Add(subscribeRetryInterval))
+		return false
+	}
+	_subscribeRetry.Delete(subscriptionKey(u.DeviceID, event))
+	return true
+}
+
+// syncCatalog 同步设备目录，开启目录订阅时通过NOTIFY增量更新，订阅建立时查询完整目录
+// 订阅失败时与订阅重试同步查询完整目录，未开启目录订阅时每次心跳查询
+func syncCatalog(u Devices) {
+	if config.Subscribe.Catalog > 0 {
+		if _, ok := getSubscription(u.DeviceID, SubscribeEventCatalog); ok {
+			return
+		}
+		if !subscribeRetryAllowed(u.DeviceID, SubscribeEventCatalog) {
+			return
+		}
+		ensureSubscription(u, SubscribeEventCatalog, config.Subscribe.Catalog, func() []byte {
+			return sip.GetCatalogXML(u.DeviceID)
+		})
+	}
+	sipCatalog(u)
+}
@@ -1,12 +1,14 @@
 package sipapi
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/panjjo/gosip/db"
 	"github.com/panjjo/gosip/m"
@@ -22,13 +24,41 @@ func Start() {
 	db.DBClient.AutoMigrate(new(Streams))
 	db.DBClient.AutoMigrate(new(m.SysInfo))
 	db.DBClient.AutoMigrate(new(Files))
+	db.DBClient.AutoMigrate(new(Alarms))
+	db.DBClient.AutoMigrate(new(Positions))
+	db.DBClient.AutoMigrate(new(PlatformChannels))
+	db.DBClient.AutoMigrate(new(Groups))
 
 	LoadSYSInfo()
+	for _, algorithm := range config.Auth.Algorithms {
+		if !sip.ValidAlgorithm(algorithm) {
+			logrus.Fatalln("auth algorithm not supported:", algorithm)
+		}
+	}
 
 	srv = sip.NewServer()
+	srv.SetTimers(sip.Timers{
+		T1: time.Duration(config.Timer.T1) * time.Millisecond,
+		T2: time.Duration(config.Timer.T2) * time.Millisecond,
+		T4: time.Duration(config.Timer.T4) * time.Millisecond,
+	})
 	srv.RegistHandler(sip.REGISTER, handlerRegister)
 	srv.RegistHandler(sip.MESSAGE, handlerMessage)
+	srv.RegistHandler(sip.NOTIFY, handlerNotify)
+	srv.RegistHandler(sip.INVITE, handlerInvite)
+	srv.RegistHandler(sip.BYE, handlerBye)
 	go srv.ListenUDPServer(config.UDP)
+	if config.TCP != "" {
+		go srv.ListenTCPServer(config.TCP)
+	}
+	if config.TLS.Addr != "" {
+		tlsConfig, err := sip.NewTLSConfig(config.TLS.Cert, config.TLS.Key, config.TLS.CA)
+		if err != nil {
+			logrus.Fatalln("init tls config error:", err)
+		}
+		go srv.ListenTLSServer(config.TLS.Addr, tlsConfig)
+	}
+	StartCascade()
 }
 
 // MODDEBUG MODDEBUG
@@ -61,6 +91,11 @@ func LoadSYSInfo() {
 	StreamList = streamsList{&sync.Map{}, &sync.Map{}, 0}
 	ssrcLock = &sync.Mutex{}
 	_recordList = &sync.Map{}
+	_presetList = &sync.Map{}
+	_subscriptions = &sync.Map{}
+	_nonces = sip.NewNonceStore(nonceTTL, nonceMax)
+	_platforms = &sync.Map{}
+	_cascadeSessions = &sync.Map{}
 	RecordList = apiRecordList{items: map[string]*apiRecordItem{}, l: sync.RWMutex{}}
 
 	// init sysinfo
@@ -112,6 +147,18 @@ func ssrc2stream(ssrc string) string {
 	return fmt.Sprintf("%08X", num)
 }
 
+// sipRequest 发送请求并等待最终响应，ctx取消时返回ctx.Err()
+func sipRequest(ctx context.Context, req *sip.Request) (*sip.Response, error) {
+	response, err := srv.RequestContext(ctx, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode() != http.StatusOK {
+		return response, utils.NewError(nil, "response fail", response.StatusCode(), response.Reason())
+	}
+	return response, nil
+}
+
 func sipResponse(tx *sip.Transaction) (*sip.Response, error) {
 	response := tx.GetResponse()
 	if response == nil {
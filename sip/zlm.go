@@ -135,3 +135,43 @@ func zlmStopRecord(values url.Values) error {
 	}
 	return nil
 }
+
+type zlmSendRtpResp struct {
+	Code      int    `json:"code"`
+	Msg       string `json:"msg"`
+	LocalPort int    `json:"local_port"`
+}
+
+// zlm 开始向外发送rtp流，passive为true时等待对端tcp连接，返回本地端口
+func zlmStartSendRtp(values url.Values, passive bool) (int, error) {
+	api := "/index/api/startSendRtp?"
+	if passive {
+		api = "/index/api/startSendRtpPassive?"
+	}
+	values.Set("secret", config.Media.Secret)
+	values.Set("vhost", "__defaultVhost__")
+	values.Set("app", "rtp")
+	body, err := utils.GetRequest(config.Media.RESTFUL + api + values.Encode())
+	if err != nil {
+		return 0, err
+	}
+	res := zlmSendRtpResp{}
+	if err = utils.JSONDecode(body, &res); err != nil {
+		return 0, err
+	}
+	if res.Code != 0 {
+		return 0, utils.NewError(nil, "startSendRtp fail", res.Code, res.Msg)
+	}
+	return res.LocalPort, nil
+}
+
+// zlm 停止发送rtp流
+func zlmStopSendRtp(streamID, ssrc string) {
+	values := url.Values{}
+	values.Set("secret", config.Media.Secret)
+	values.Set("vhost", "__defaultVhost__")
+	values.Set("app", "rtp")
+	values.Set("stream", streamID)
+	values.Set("ssrc", ssrc)
+	utils.GetRequest(config.Media.RESTFUL + "/index/api/stopSendRtp?" + values.Encode())
+}